@@ -3,8 +3,10 @@ module github.com/ltkh/relay-server
 go 1.15
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/influxdata/line-protocol v0.0.0-20210311194329-9aa0e372d097
 	github.com/prometheus/client_golang v1.10.0
+	github.com/prometheus/client_model v0.2.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	gopkg.in/yaml.v2 v2.4.0
 )
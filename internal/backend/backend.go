@@ -0,0 +1,212 @@
+package backend
+
+import (
+    "crypto/tls"
+    "net/http"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/ltkh/relay-server/internal/logger"
+    "github.com/ltkh/relay-server/internal/monitor"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+    Closed       = "closed"
+    HalfOpen     = "half-open"
+    Open         = "open"
+
+    Unknown      = "unknown"
+    Up           = "up"
+    Down         = "down"
+)
+
+var (
+    mu           sync.Mutex
+    backends     = make(map[string]*Backend)
+)
+
+//Backend is the state shared by every sender writing to one backend url
+type Backend struct {
+    mu           sync.Mutex
+    Url          string
+    threshold    int
+    cooldown     time.Duration
+    state        string
+    failures     int
+    opened       time.Time
+    probing      bool
+    health       string
+    rise         int
+    fall         int
+    latency      time.Duration
+    lastError    string
+    checked      time.Time
+    stop         chan struct{}
+    transport    http.RoundTripper
+    inflight     int64
+}
+
+//Get returns the backend of a url, creating it with a disabled breaker on first use
+func Get(url string) *Backend {
+    mu.Lock()
+    defer mu.Unlock()
+
+    b, ok := backends[url]
+    if !ok {
+        b = &Backend{Url: url, state: Closed, health: Unknown}
+        backends[url] = b
+        setState(url, Closed)
+    }
+    return b
+}
+
+//All returns every known backend ordered by url
+func All() []*Backend {
+    mu.Lock()
+    defer mu.Unlock()
+
+    list := make([]*Backend, 0, len(backends))
+    for _, b := range backends {
+        list = append(list, b)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Url < list[j].Url })
+
+    return list
+}
+
+//Configure sets how many consecutive failures open the breaker and how many seconds it stays open
+//before a single probe request may go through; a threshold of 0 disables the breaker
+func (b *Backend) Configure(threshold int, cooldown time.Duration) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    b.threshold, b.cooldown = threshold, cooldown
+    if threshold <= 0 && b.state != Closed {
+        b.transition(Closed)
+    }
+}
+
+//SetTLS makes requests to the backend use the given tls settings, nil restores the defaults
+func (b *Backend) SetTLS(conf *tls.Config) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    //connections of the replaced transport would otherwise stay open with the old settings
+    if old, ok := b.transport.(*http.Transport); ok {
+        old.CloseIdleConnections()
+    }
+
+    if conf == nil {
+        b.transport = nil
+        return
+    }
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.TLSClientConfig = conf
+    b.transport = transport
+}
+
+//Transport returns the transport of requests to the backend
+func (b *Backend) Transport() http.RoundTripper {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.transport == nil {
+        return http.DefaultTransport
+    }
+    return b.transport
+}
+
+//Begin and End count the requests being sent to the backend
+func (b *Backend) Begin() {
+    atomic.AddInt64(&b.inflight, 1)
+    monitor.InFlight.With(prometheus.Labels{"url":b.Url}).Inc()
+}
+
+func (b *Backend) End() {
+    atomic.AddInt64(&b.inflight, -1)
+    monitor.InFlight.With(prometheus.Labels{"url":b.Url}).Dec()
+}
+
+//State returns the breaker state
+func (b *Backend) State() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.state
+}
+
+//Allow reports whether a request may be sent: never while the health check reports the backend down,
+//always when the breaker is closed, never while it is open and for one probe at a time once the cool-down is over
+func (b *Backend) Allow() bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.health == Down {
+        return false
+    }
+
+    switch b.state {
+    case Open:
+        if time.Since(b.opened) < b.cooldown * time.Second {
+            return false
+        }
+        b.transition(HalfOpen)
+        b.probing = true
+        return true
+    case HalfOpen:
+        if b.probing {
+            return false
+        }
+        b.probing = true
+        return true
+    }
+    return true
+}
+
+//Success records a request the backend answered, closing a half-open breaker
+func (b *Backend) Success() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    b.failures = 0
+    b.probing = false
+    if b.state != Closed {
+        b.transition(Closed)
+    }
+}
+
+//Failure records a request the backend did not answer properly, opening the breaker
+//after enough of them in a row or at once when the probe of a half-open breaker fails
+func (b *Backend) Failure() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    b.failures++
+    b.probing = false
+    if b.threshold <= 0 {
+        return
+    }
+    if b.state == HalfOpen || (b.state == Closed && b.failures >= b.threshold) {
+        b.opened = time.Now()
+        b.transition(Open)
+    }
+}
+
+func (b *Backend) transition(state string) {
+    logger.With(logger.Fields{"url":b.Url}).Infof("circuit breaker: %s -> %s", b.state, state)
+    b.state = state
+    setState(b.Url, state)
+    monitor.BreakerTransitions.With(prometheus.Labels{"url":b.Url,"state":state}).Inc()
+}
+
+func setState(url string, state string) {
+    value := 0.0
+    switch state {
+    case HalfOpen:
+        value = 1
+    case Open:
+        value = 2
+    }
+    monitor.BreakerState.With(prometheus.Labels{"url":url}).Set(value)
+}
@@ -0,0 +1,162 @@
+package backend
+
+import (
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync/atomic"
+    "time"
+    "github.com/ltkh/relay-server/internal/logger"
+    "github.com/ltkh/relay-server/internal/monitor"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+//HealthCheck polls path on the host of a backend url every interval seconds; the backend goes down
+//after unhealthy failed checks in a row and up again after healthy successful ones
+type HealthCheck struct {
+    Path         string
+    Interval     time.Duration
+    Timeout      time.Duration
+    Healthy      int
+    Unhealthy    int
+}
+
+//Status is the state of a backend as reported by the status endpoint
+type Status struct {
+    Url          string    `json:"url"`
+    Breaker      string    `json:"breaker"`
+    Health       string    `json:"health"`
+    Latency      float64   `json:"latency_seconds"`
+    InFlight     int64     `json:"in_flight"`
+    LastError    string    `json:"last_error,omitempty"`
+    Checked      time.Time `json:"checked,omitempty"`
+}
+
+//Watch starts checking the health of the backend, replacing any check started before
+func (b *Backend) Watch(hc HealthCheck) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.stop != nil {
+        close(b.stop)
+    }
+    b.stop = make(chan struct{})
+
+    go b.watch(hc, b.stop)
+}
+
+//Unwatch stops checking the health of the backend, which then counts as up
+func (b *Backend) Unwatch() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.stop != nil {
+        close(b.stop)
+        b.stop = nil
+    }
+    b.health = Unknown
+    monitor.BackendUp.Delete(prometheus.Labels{"url":b.Url})
+}
+
+func (b *Backend) watch(hc HealthCheck, stop chan struct{}) {
+    ticker := time.NewTicker(hc.Interval * time.Second)
+    defer ticker.Stop()
+
+    for {
+        start := time.Now()
+        err := check(b.Url, hc.Path, hc.Timeout, b.Transport())
+        b.checkResult(hc, time.Since(start), err, stop)
+
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+func (b *Backend) checkResult(hc HealthCheck, latency time.Duration, err error, stop chan struct{}) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    //the check was replaced while it ran
+    if b.stop != stop {
+        return
+    }
+
+    b.latency, b.checked = latency, time.Now()
+    health := b.health
+    if err == nil {
+        b.lastError = ""
+        b.rise++
+        b.fall = 0
+        if b.rise >= hc.Healthy {
+            health = Up
+        }
+    } else {
+        b.lastError = err.Error()
+        b.fall++
+        b.rise = 0
+        if b.fall >= hc.Unhealthy {
+            health = Down
+        }
+    }
+
+    if health != b.health {
+        if health == Down {
+            logger.With(logger.Fields{"url":b.Url}).Errorf("health check: %s -> %s: %v", b.health, health, err)
+        } else {
+            logger.With(logger.Fields{"url":b.Url}).Infof("health check: %s -> %s", b.health, health)
+        }
+        b.health = health
+    }
+
+    switch b.health {
+    case Up:
+        monitor.BackendUp.With(prometheus.Labels{"url":b.Url}).Set(1)
+    case Down:
+        monitor.BackendUp.With(prometheus.Labels{"url":b.Url}).Set(0)
+    }
+}
+
+//Status returns the breaker and health state of the backend
+func (b *Backend) Status() Status {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    return Status{
+        Url:       b.Url,
+        Breaker:   b.state,
+        Health:    b.health,
+        Latency:   b.latency.Seconds(),
+        InFlight:  atomic.LoadInt64(&b.inflight),
+        LastError: b.lastError,
+        Checked:   b.checked,
+    }
+}
+
+//check requests path on the host of a backend write url
+func check(rawurl string, path string, timeout time.Duration, transport http.RoundTripper) error {
+    u, err := url.Parse(rawurl)
+    if err != nil {
+        return err
+    }
+    u.Path, u.RawQuery = path, ""
+
+    client := &http.Client{ Timeout: timeout * time.Second, Transport: transport }
+    resp, err := client.Get(u.String())
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("%s returned %d: %s", u.String(), resp.StatusCode, strings.TrimSpace(string(body)))
+    }
+
+    return nil
+}
@@ -0,0 +1,386 @@
+package cache
+
+import (
+    "io"
+    "io/ioutil"
+    "math"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "github.com/ltkh/relay-server/internal/logger"
+    "github.com/ltkh/relay-server/internal/monitor"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+//unmigrated holds the cache files of older versions Migrate could not place
+const unmigrated = ".unmigrated"
+
+//lockFile keeps two processes from writing the same cache directory
+const lockFile = ".lock"
+
+//Options controls how the location logs are written and how much they may hold
+type Options struct {
+    SegmentSize  int64
+    Fsync        string
+    FsyncInterval time.Duration
+    MaxBytes     int64
+    MaxEntries   int
+    MaxAge       time.Duration
+    MinFree      int64
+    Eviction     string
+    MaxAttempts  int
+    DeadLetter   string
+    ReadOnly     bool
+}
+
+//Cache keeps one write-ahead log per location below a directory
+type Cache struct {
+    mu           sync.Mutex
+    dir          string
+    opts         Options
+    wals         map[string]*WAL
+    dead         *DeadLetter
+    lock         *os.File
+}
+
+//Open opens the cache directory together with every location log already present in it
+func Open(dir string, opts Options) (*Cache, error) {
+    if opts.DeadLetter == "" {
+        opts.DeadLetter = filepath.Join(dir, ".dead-letter")
+    }
+
+    var dead *DeadLetter
+    if opts.ReadOnly {
+        dead = &DeadLetter{dir: opts.DeadLetter}
+    } else {
+        if err := os.MkdirAll(dir, 0755); err != nil {
+            return nil, err
+        }
+        var err error
+        if dead, err = OpenDeadLetter(opts.DeadLetter); err != nil {
+            return nil, err
+        }
+    }
+
+    c := &Cache{dir: dir, opts: opts, wals: make(map[string]*WAL), dead: dead}
+
+    //writers lock the directory exclusively, read-only opens share it among themselves
+    file, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_RDONLY, 0644)
+    if err != nil {
+        return nil, err
+    }
+    if err := lock(file, opts.ReadOnly); err != nil {
+        file.Close()
+        return nil, err
+    }
+    c.lock = file
+
+    files, err := ioutil.ReadDir(dir)
+    if err != nil {
+        c.Close()
+        return nil, err
+    }
+    for _, file := range files {
+        if !file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+            continue
+        }
+        if _, err := c.Location(file.Name()); err != nil {
+            c.Close()
+            return nil, err
+        }
+    }
+
+    return c, nil
+}
+
+//Dir returns the cache directory
+func (c *Cache) Dir() string {
+    return c.dir
+}
+
+//DeadLetter returns the store of given up entries
+func (c *Cache) DeadLetter() *DeadLetter {
+    return c.dead
+}
+
+//Location returns the log of the location with the given id, opening it on first use
+func (c *Cache) Location(id string) (*WAL, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if wal, ok := c.wals[id]; ok {
+        return wal, nil
+    }
+
+    wal, err := OpenWAL(filepath.Join(c.dir, id), c.opts)
+    if err != nil {
+        return nil, err
+    }
+    c.wals[id] = wal
+
+    return wal, nil
+}
+
+//Locations returns the ids of all open location logs
+func (c *Cache) Locations() []string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    ids := make([]string, 0, len(c.wals))
+    for id := range c.wals {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+
+    return ids
+}
+
+//Close closes every location log
+func (c *Cache) Close() error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    var err error
+    for id, wal := range c.wals {
+        if cerr := wal.Close(); cerr != nil && err == nil {
+            err = cerr
+        }
+        delete(c.wals, id)
+    }
+    if c.lock != nil {
+        //closing the file releases the lock
+        if cerr := c.lock.Close(); cerr != nil && err == nil {
+            err = cerr
+        }
+        c.lock = nil
+    }
+
+    return err
+}
+
+//Migrate moves the one-file-per-request entries of older versions into the location logs,
+//oldest file first, using locate to find the location of each entry; files it can not place
+//or read are moved aside into the .unmigrated directory
+func (c *Cache) Migrate(locate func(data []byte) (string, error)) (int, error) {
+    files, err := ioutil.ReadDir(c.dir)
+    if err != nil {
+        return 0, err
+    }
+    sort.SliceStable(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+
+    cnt := 0
+
+    for _, file := range files {
+        if !file.Mode().IsRegular() || strings.HasPrefix(file.Name(), ".") {
+            continue
+        }
+
+        path := filepath.Join(c.dir, file.Name())
+
+        data, err := ioutil.ReadFile(path)
+        if err != nil {
+            if err := c.unmigrated(file.Name(), err); err != nil {
+                return cnt, err
+            }
+            continue
+        }
+
+        id, err := locate(data)
+        if err != nil {
+            if err := c.unmigrated(file.Name(), err); err != nil {
+                return cnt, err
+            }
+            continue
+        }
+
+        wal, err := c.Location(id)
+        if err != nil {
+            return cnt, err
+        }
+        if err := wal.Append(data); err != nil {
+            return cnt, err
+        }
+        if err := wal.Sync(); err != nil {
+            return cnt, err
+        }
+        cnt++
+
+        if err := os.Remove(path); err != nil {
+            return cnt, err
+        }
+    }
+
+    return cnt, nil
+}
+
+//unmigrated moves a cache file Migrate could not read or place into the .unmigrated directory
+func (c *Cache) unmigrated(name string, reason error) error {
+    logger.Errorf("migrating cache file: %s: %v, moving it to %s", name, reason, unmigrated)
+    if err := os.MkdirAll(filepath.Join(c.dir, unmigrated), 0755); err != nil {
+        return err
+    }
+    return os.Rename(filepath.Join(c.dir, name), filepath.Join(c.dir, unmigrated, name))
+}
+
+//Failed records a failed replay of entry, the head of wal, and moves it to the dead-letter store
+//once it ran out of attempts; it reports whether the entry was given up on
+func (c *Cache) Failed(wal *WAL, entry *Entry, next Position, reason string) (bool, error) {
+    attempts, err := wal.Fail(reason)
+    if err != nil {
+        return false, err
+    }
+    if c.opts.MaxAttempts <= 0 || entry.Attempts+attempts < c.opts.MaxAttempts {
+        return false, nil
+    }
+
+    entry.Attempts += attempts
+    entry.Error = reason
+    if entry.Location == "" {
+        entry.Location = wal.ID()
+    }
+    if err := c.dead.Add(&Letter{Reason: "max_attempts", Entry: entry}); err != nil {
+        return false, err
+    }
+
+    return true, wal.Commit(next)
+}
+
+//Enforce evicts entries until the cache is within its age, size and free disk space limits
+func (c *Cache) Enforce() {
+    c.mu.Lock()
+    wals := make([]*WAL, 0, len(c.wals))
+    for _, wal := range c.wals {
+        wals = append(wals, wal)
+    }
+    c.mu.Unlock()
+
+    if c.opts.MaxAge > 0 {
+        for _, wal := range wals {
+            cnt := 0
+            for {
+                entry, next, err := wal.Head()
+                if err != nil || time.Since(entry.Failed) <= c.opts.MaxAge * time.Second {
+                    break
+                }
+                if err := wal.Commit(next); err != nil {
+                    logger.With(logger.Fields{"location":wal.ID()}).Errorf("evicting cache entry: %v", err)
+                    break
+                }
+                cnt++
+            }
+            if cnt > 0 {
+                evicted(wal, "max_age", cnt)
+            }
+        }
+    }
+
+    dropped := make(map[*WAL]int)
+    for c.opts.MaxBytes > 0 || c.opts.MaxEntries > 0 {
+        stats, total := c.stats(wals)
+        if (c.opts.MaxBytes <= 0 || total.Bytes <= c.opts.MaxBytes) && (c.opts.MaxEntries <= 0 || total.Entries <= c.opts.MaxEntries) {
+            break
+        }
+        wal := c.victim(wals, stats)
+        if wal == nil {
+            break
+        }
+        _, next, err := wal.Read(wal.Position())
+        if err == io.EOF {
+            break
+        }
+        if err == nil {
+            err = wal.Commit(next)
+        }
+        if err != nil {
+            logger.With(logger.Fields{"location":wal.ID()}).Errorf("evicting cache entry: %v", err)
+            break
+        }
+        dropped[wal]++
+    }
+    for wal, cnt := range dropped {
+        evicted(wal, "limit", cnt)
+    }
+
+    for c.opts.MinFree > 0 {
+        free, err := diskFree(c.dir)
+        if err != nil {
+            logger.Errorf("checking cache disk space: %v", err)
+            break
+        }
+        if free >= c.opts.MinFree {
+            break
+        }
+        stats, _ := c.stats(wals)
+        wal := c.victim(wals, stats)
+        if wal == nil {
+            break
+        }
+        cnt, err := wal.SkipSegment()
+        if err != nil {
+            logger.With(logger.Fields{"location":wal.ID()}).Errorf("evicting cache segment: %v", err)
+            break
+        }
+        if cnt == 0 {
+            break
+        }
+        evicted(wal, "disk_free", cnt)
+    }
+}
+
+func (c *Cache) stats(wals []*WAL) (map[*WAL]Stats, Stats) {
+    stats := make(map[*WAL]Stats, len(wals))
+    total := Stats{}
+    for _, wal := range wals {
+        st := wal.Stats()
+        stats[wal] = st
+        total.Entries += st.Entries
+        total.Bytes += st.Bytes
+    }
+    return stats, total
+}
+
+//victim picks the log to evict from: the one holding the oldest entry, or with "fair_share"
+//the one using the largest part of the limits, so no location is starved by another's backlog
+func (c *Cache) victim(wals []*WAL, stats map[*WAL]Stats) *WAL {
+    var victim *WAL
+    var best float64
+
+    for _, wal := range wals {
+        st := stats[wal]
+        if st.Entries == 0 {
+            continue
+        }
+
+        var score float64
+        if c.opts.Eviction == "fair_share" {
+            if c.opts.MaxBytes > 0 {
+                score = float64(st.Bytes) / float64(c.opts.MaxBytes)
+            }
+            if c.opts.MaxEntries > 0 && float64(st.Entries) / float64(c.opts.MaxEntries) > score {
+                score = float64(st.Entries) / float64(c.opts.MaxEntries)
+            }
+            if score == 0 {
+                score = float64(st.Bytes)
+            }
+        } else if !st.Oldest.IsZero() {
+            score = -float64(st.Oldest.UnixNano())
+        } else {
+            //the head can not be read, it goes first
+            score = math.MaxFloat64
+        }
+
+        if victim == nil || score > best {
+            victim, best = wal, score
+        }
+    }
+
+    return victim
+}
+
+func evicted(wal *WAL, reason string, cnt int) {
+    monitor.CacheEvicted.With(prometheus.Labels{"location":wal.ID(),"reason":reason}).Add(float64(cnt))
+    logger.With(logger.Fields{"location":wal.ID(),"reason":reason}).Infof("evicted %d cache entries", cnt)
+}
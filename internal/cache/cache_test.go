@@ -0,0 +1,43 @@
+package cache
+
+import (
+    "io/ioutil"
+    "os"
+    "testing"
+)
+
+func TestOpenLocked(t *testing.T) {
+    dir, err := ioutil.TempDir("", "cache")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    c, err := Open(dir, Options{Fsync: "never"})
+    if err != nil {
+        t.Fatalf("opening cache: %v", err)
+    }
+    if _, err := Open(dir, Options{Fsync: "never"}); err == nil {
+        t.Fatal("opened a cache another writer holds")
+    }
+    if _, err := Open(dir, Options{ReadOnly: true}); err == nil {
+        t.Fatal("opened read-only a cache another writer holds")
+    }
+    if err := c.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    r1, err := Open(dir, Options{ReadOnly: true})
+    if err != nil {
+        t.Fatalf("opening read-only: %v", err)
+    }
+    defer r1.Close()
+    r2, err := Open(dir, Options{ReadOnly: true})
+    if err != nil {
+        t.Fatalf("opening read-only a second time: %v", err)
+    }
+    r2.Close()
+    if _, err := Open(dir, Options{Fsync: "never"}); err == nil {
+        t.Fatal("opened for writing a cache a reader holds")
+    }
+}
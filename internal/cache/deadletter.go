@@ -0,0 +1,147 @@
+package cache
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync/atomic"
+    "time"
+    "github.com/ltkh/relay-server/internal/logger"
+    "github.com/ltkh/relay-server/internal/monitor"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+//Letter is an entry that was given up on, kept with the reason why and,
+//when a backend rejected it, the response it got
+type Letter struct {
+    ID           string      `json:"id"`
+    Time         time.Time   `json:"time"`
+    Reason       string      `json:"reason"`
+    Url          string      `json:"url,omitempty"`
+    Status       int         `json:"status,omitempty"`
+    Response     string      `json:"response,omitempty"`
+    Entry        *Entry      `json:"entry"`
+}
+
+//DeadLetter stores given up entries one file each, so they can be inspected and removed individually
+type DeadLetter struct {
+    dir          string
+}
+
+//letterSeq keeps ids unique within the process
+var letterSeq uint32
+
+//OpenDeadLetter opens the dead-letter directory, creating it if needed
+func OpenDeadLetter(dir string) (*DeadLetter, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+
+    d := &DeadLetter{dir: dir}
+
+    //the gauge starts from what previous runs left behind
+    if letters, err := d.List(); err == nil {
+        counts := make(map[string]int)
+        for _, letter := range letters {
+            counts[letter.Reason]++
+        }
+        monitor.DeadLetters.Reset()
+        for reason, cnt := range counts {
+            monitor.DeadLetters.With(prometheus.Labels{"reason":reason}).Set(float64(cnt))
+        }
+    }
+
+    return d, nil
+}
+
+//Dir returns the dead-letter directory
+func (d *DeadLetter) Dir() string {
+    return d.dir
+}
+
+//Add stores the letter, assigning its id and time
+func (d *DeadLetter) Add(letter *Letter) error {
+    letter.Time = time.Now()
+    letter.ID = fmt.Sprintf("%d-%06d", letter.Time.UnixNano(), atomic.AddUint32(&letterSeq, 1) % 1000000)
+
+    data, err := json.Marshal(letter)
+    if err != nil {
+        return err
+    }
+    if err := writeFileAtomic(filepath.Join(d.dir, letter.ID+".json"), data, true); err != nil {
+        return err
+    }
+
+    monitor.DeadLetters.With(prometheus.Labels{"reason":letter.Reason}).Inc()
+    monitor.DeadLettered.With(prometheus.Labels{"reason":letter.Reason}).Inc()
+
+    location := ""
+    if letter.Entry != nil {
+        location = letter.Entry.Location
+    }
+    logger.With(logger.Fields{"location":location,"reason":letter.Reason}).Infof("moved batch to dead-letter: %s", letter.ID)
+
+    return nil
+}
+
+//List returns all letters, oldest first
+func (d *DeadLetter) List() ([]*Letter, error) {
+    files, err := ioutil.ReadDir(d.dir)
+    if err != nil {
+        return nil, err
+    }
+
+    var letters []*Letter
+    for _, file := range files {
+        if !strings.HasSuffix(file.Name(), ".json") {
+            continue
+        }
+        letter, err := d.Get(strings.TrimSuffix(file.Name(), ".json"))
+        if err != nil {
+            logger.Errorf("reading dead-letter: %s: %v", file.Name(), err)
+            continue
+        }
+        letters = append(letters, letter)
+    }
+    sort.Slice(letters, func(i, j int) bool { return letters[i].ID < letters[j].ID })
+
+    return letters, nil
+}
+
+//Get returns the letter with the given id
+func (d *DeadLetter) Get(id string) (*Letter, error) {
+    if id == "" || strings.ContainsAny(id, "/\\") || strings.HasPrefix(id, ".") {
+        return nil, fmt.Errorf("invalid dead-letter id %q", id)
+    }
+
+    data, err := ioutil.ReadFile(filepath.Join(d.dir, id+".json"))
+    if err != nil {
+        return nil, err
+    }
+
+    letter := &Letter{}
+    if err := json.Unmarshal(data, letter); err != nil {
+        return nil, err
+    }
+
+    return letter, nil
+}
+
+//Remove deletes the letter with the given id
+func (d *DeadLetter) Remove(id string) error {
+    letter, err := d.Get(id)
+    if err != nil {
+        return err
+    }
+    if err := os.Remove(filepath.Join(d.dir, id+".json")); err != nil {
+        return err
+    }
+
+    monitor.DeadLetters.With(prometheus.Labels{"reason":letter.Reason}).Dec()
+
+    return nil
+}
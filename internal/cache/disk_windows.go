@@ -0,0 +1,10 @@
+package cache
+
+import (
+    "errors"
+)
+
+//diskFree is not available on windows, so the free space floor is not enforced there
+func diskFree(dir string) (int64, error) {
+    return 0, errors.New("disk free space is not supported on windows")
+}
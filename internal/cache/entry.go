@@ -0,0 +1,33 @@
+package cache
+
+import (
+    "encoding/json"
+    "time"
+)
+
+//Entry is a cached batch together with where it came from and how its delivery went so far
+type Entry struct {
+    Stream       string          `json:"stream,omitempty"`
+    Location     string          `json:"location,omitempty"`
+    Failed       time.Time       `json:"failed"`
+    Attempts     int             `json:"attempts"`
+    Error        string          `json:"error,omitempty"`
+    Data         json.RawMessage `json:"data"`
+}
+
+//Decode reads a log record, accepting the bare batches written before entries carried metadata
+func Decode(record []byte) (*Entry, error) {
+    entry := &Entry{}
+    if err := json.Unmarshal(record, entry); err != nil {
+        return nil, err
+    }
+    if entry.Data == nil {
+        entry = &Entry{Data: json.RawMessage(append([]byte(nil), record...))}
+    }
+    return entry, nil
+}
+
+//Encode returns the log record of the entry
+func (e *Entry) Encode() ([]byte, error) {
+    return json.Marshal(e)
+}
@@ -0,0 +1,24 @@
+// +build !windows
+
+package cache
+
+import (
+    "fmt"
+    "os"
+    "syscall"
+)
+
+//lock takes an advisory lock on file, shared for readers, failing at once when another process holds it
+func lock(file *os.File, shared bool) error {
+    how := syscall.LOCK_EX
+    if shared {
+        how = syscall.LOCK_SH
+    }
+    if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+        if err == syscall.EWOULDBLOCK {
+            return fmt.Errorf("%s is locked by another process, is relay-server or a cache command running on it?", file.Name())
+        }
+        return err
+    }
+    return nil
+}
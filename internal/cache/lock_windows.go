@@ -0,0 +1,10 @@
+package cache
+
+import (
+    "os"
+)
+
+//lock is not available on windows, so concurrent use of a cache directory is not detected there
+func lock(file *os.File, shared bool) error {
+    return nil
+}
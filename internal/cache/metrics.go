@@ -0,0 +1,39 @@
+package cache
+
+import (
+    "time"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+    entriesDesc = prometheus.NewDesc("relay_server_cache_entries", "Batches held in the cache of a location.", []string{"location"}, nil)
+    bytesDesc   = prometheus.NewDesc("relay_server_cache_bytes", "Bytes held in the cache of a location.", []string{"location"}, nil)
+    filesDesc   = prometheus.NewDesc("relay_server_cache_files", "Segment files of the cache of a location.", []string{"location"}, nil)
+    oldestDesc  = prometheus.NewDesc("relay_server_cache_oldest_age_seconds", "Age of the oldest batch in the cache of a location.", []string{"location"}, nil)
+)
+
+//Describe and Collect export the statistics of the location logs when the metrics are scraped
+func (c *Cache) Describe(ch chan<- *prometheus.Desc) {
+    ch <- entriesDesc
+    ch <- bytesDesc
+    ch <- filesDesc
+    ch <- oldestDesc
+}
+
+func (c *Cache) Collect(ch chan<- prometheus.Metric) {
+    for _, id := range c.Locations() {
+        wal, err := c.Location(id)
+        if err != nil {
+            continue
+        }
+        st := wal.Stats()
+        age := 0.0
+        if !st.Oldest.IsZero() {
+            age = time.Since(st.Oldest).Seconds()
+        }
+        ch <- prometheus.MustNewConstMetric(entriesDesc, prometheus.GaugeValue, float64(st.Entries), id)
+        ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.GaugeValue, float64(st.Bytes), id)
+        ch <- prometheus.MustNewConstMetric(filesDesc, prometheus.GaugeValue, float64(st.Segments), id)
+        ch <- prometheus.MustNewConstMetric(oldestDesc, prometheus.GaugeValue, age, id)
+    }
+}
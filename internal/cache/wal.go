@@ -0,0 +1,659 @@
+package cache
+
+import (
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "github.com/ltkh/relay-server/internal/logger"
+)
+
+const (
+    headerSize   = 8
+    maxRecord    = 256 << 20
+    offsetFile   = "offset"
+    segmentExt   = ".wal"
+)
+
+var (
+    castagnoli   = crc32.MakeTable(crc32.Castagnoli)
+    errCorrupt   = errors.New("corrupt record")
+    errReadOnly  = errors.New("cache is opened read-only")
+)
+
+//Position points at a record inside the log
+type Position struct {
+    Segment      uint64      `json:"segment"`
+    Offset       int64       `json:"offset"`
+}
+
+//state is what the offset file keeps: the read position and the failures of the record found there
+type state struct {
+    Position
+    Attempts     int         `json:"attempts,omitempty"`
+    Error        string      `json:"error,omitempty"`
+}
+
+type segment struct {
+    id           uint64
+    size         int64
+    records      int
+}
+
+//Stats describes the records of a log that have not been read yet
+type Stats struct {
+    Entries      int          `json:"entries"`
+    Bytes        int64        `json:"bytes"`
+    Segments     int          `json:"segments"`
+    Oldest       time.Time    `json:"oldest"`
+}
+
+//WAL is an append-only log split into segments, read in FIFO order from a persisted offset
+type WAL struct {
+    mu           sync.Mutex
+    id           string
+    dir          string
+    opts         Options
+    segments     []*segment
+    file         *os.File
+    state        state
+    consumed     int
+    dirty        bool
+    closed       chan struct{}
+}
+
+//OpenWAL opens the log in dir, creating it if needed and cutting off a torn tail
+func OpenWAL(dir string, opts Options) (*WAL, error) {
+    if !opts.ReadOnly {
+        if err := os.MkdirAll(dir, 0755); err != nil {
+            return nil, err
+        }
+    }
+
+    w := &WAL{id: filepath.Base(dir), dir: dir, opts: opts, closed: make(chan struct{})}
+
+    files, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    for _, file := range files {
+        var id uint64
+        if _, err := fmt.Sscanf(file.Name(), "%d"+segmentExt, &id); err == nil && strings.HasSuffix(file.Name(), segmentExt) {
+            w.segments = append(w.segments, &segment{id: id})
+        }
+    }
+    sort.Slice(w.segments, func(i, j int) bool { return w.segments[i].id < w.segments[j].id })
+
+    if len(w.segments) == 0 {
+        w.segments = []*segment{{id: 1}}
+    }
+
+    for i, seg := range w.segments {
+        size, records, err := scanSegment(w.segmentPath(seg.id), -1, i == len(w.segments)-1)
+        if err != nil {
+            return nil, err
+        }
+        seg.size, seg.records = size, records
+    }
+
+    last := w.segments[len(w.segments)-1]
+    if !opts.ReadOnly {
+        if err := w.quarantine(last); err != nil {
+            return nil, err
+        }
+        w.file, err = os.OpenFile(w.segmentPath(last.id), os.O_CREATE|os.O_WRONLY, 0644)
+        if err != nil {
+            return nil, err
+        }
+        if err := w.file.Truncate(last.size); err != nil {
+            w.file.Close()
+            return nil, err
+        }
+        if _, err := w.file.Seek(last.size, io.SeekStart); err != nil {
+            w.file.Close()
+            return nil, err
+        }
+    }
+
+    if data, err := ioutil.ReadFile(filepath.Join(dir, offsetFile)); err == nil {
+        if err := json.Unmarshal(data, &w.state); err != nil {
+            logger.With(logger.Fields{"location":w.id}).Errorf("reading cache offset: %s: %v", dir, err)
+        }
+    }
+    if w.state.Segment < w.segments[0].id {
+        w.state = state{Position: Position{Segment: w.segments[0].id}}
+    }
+    if w.state.Segment > last.id || (w.state.Segment == last.id && w.state.Offset > last.size) {
+        w.state = state{Position: Position{Segment: last.id, Offset: last.size}}
+    }
+    if w.segment(w.state.Segment) == nil {
+        w.state = state{Position: Position{Segment: w.segments[w.index(w.state.Segment)].id}}
+    }
+    if _, w.consumed, err = scanSegment(w.segmentPath(w.state.Segment), w.state.Offset, false); err != nil {
+        return nil, err
+    }
+
+    if opts.Fsync == "interval" && !opts.ReadOnly {
+        go w.syncLoop()
+    }
+
+    return w, nil
+}
+
+func (w *WAL) segmentPath(id uint64) string {
+    return filepath.Join(w.dir, fmt.Sprintf("%08d%s", id, segmentExt))
+}
+
+//quarantine copies what follows the intact prefix of seg, when a damaged record is followed by more data,
+//into a .corrupt file next to it before the segment is cut back; a torn last write is simply dropped
+func (w *WAL) quarantine(seg *segment) error {
+    path := w.segmentPath(seg.id)
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return err
+    }
+    if int64(len(data)) <= seg.size {
+        return nil
+    }
+
+    tail := data[seg.size:]
+    if size, err := readSize(tail); err == io.ErrUnexpectedEOF || (err == nil && int64(headerSize)+int64(size) >= int64(len(tail))) {
+        return nil
+    }
+
+    dest := fmt.Sprintf("%s.%d.corrupt", path, seg.size)
+    logger.With(logger.Fields{"location":w.id}).Errorf("damaged cache segment: %s at %d, moving %d bytes to %s", path, seg.size, len(tail), dest)
+    return writeFileAtomic(dest, tail, true)
+}
+
+//index returns the index of the first segment with an id not below id
+func (w *WAL) index(id uint64) int {
+    return sort.Search(len(w.segments), func(i int) bool { return w.segments[i].id >= id })
+}
+
+func (w *WAL) segment(id uint64) *segment {
+    idx := w.index(id)
+    if idx < len(w.segments) && w.segments[idx].id == id {
+        return w.segments[idx]
+    }
+    return nil
+}
+
+func (w *WAL) active() *segment {
+    return w.segments[len(w.segments)-1]
+}
+
+//ID returns the id of the location the log belongs to
+func (w *WAL) ID() string {
+    return w.id
+}
+
+//Dir returns the directory holding the segments
+func (w *WAL) Dir() string {
+    return w.dir
+}
+
+//Append writes one checksummed record at the end of the log
+func (w *WAL) Append(data []byte) error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    if w.opts.ReadOnly {
+        return errReadOnly
+    }
+    if w.file == nil {
+        return errors.New("cache is closed")
+    }
+
+    active := w.active()
+    if w.opts.SegmentSize > 0 && active.size > 0 && active.size+int64(len(data))+headerSize > w.opts.SegmentSize {
+        if err := w.rotate(); err != nil {
+            return err
+        }
+        active = w.active()
+    }
+
+    buf := make([]byte, headerSize+len(data))
+    binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+    binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(data, castagnoli))
+    copy(buf[headerSize:], data)
+
+    n, err := w.file.Write(buf)
+    if err != nil {
+        //leave no partial record behind for the next append to be glued to
+        w.file.Truncate(active.size)
+        w.file.Seek(active.size, io.SeekStart)
+        return err
+    }
+    active.size += int64(n)
+    active.records++
+
+    if w.opts.Fsync == "always" {
+        return w.file.Sync()
+    }
+    w.dirty = true
+
+    return nil
+}
+
+//rotate closes the active segment and starts a new one
+func (w *WAL) rotate() error {
+    if err := w.file.Sync(); err != nil {
+        return err
+    }
+    if err := w.file.Close(); err != nil {
+        return err
+    }
+
+    id := w.active().id + 1
+    file, err := os.OpenFile(w.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+
+    w.file = file
+    w.segments = append(w.segments, &segment{id: id})
+
+    return nil
+}
+
+//Position returns the committed read position
+func (w *WAL) Position() Position {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    return w.state.Position
+}
+
+//Attempts returns how often the record at the read position failed to be replayed and the last error
+func (w *WAL) Attempts() (int, string) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    return w.state.Attempts, w.state.Error
+}
+
+//Read returns the record at pos and the position of the record after it, or io.EOF when the log is drained
+func (w *WAL) Read(pos Position) ([]byte, Position, error) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    for {
+        idx := w.index(pos.Segment)
+        if idx == len(w.segments) {
+            return nil, pos, io.EOF
+        }
+        seg := w.segments[idx]
+        if seg.id != pos.Segment {
+            pos = Position{Segment: seg.id}
+        }
+
+        active := idx == len(w.segments)-1
+        if active && pos.Offset >= seg.size {
+            return nil, pos, io.EOF
+        }
+
+        data, next, err := readRecord(w.segmentPath(pos.Segment), pos.Offset)
+        if err == nil {
+            return data, Position{Segment: pos.Segment, Offset: next}, nil
+        }
+        if err != io.EOF {
+            logger.With(logger.Fields{"location":w.id}).Errorf("reading cache segment: %s at %d: %v", w.segmentPath(pos.Segment), pos.Offset, err)
+            if active {
+                return nil, pos, err
+            }
+        }
+        if active {
+            return nil, pos, io.EOF
+        }
+
+        //the rest of a sealed segment is done or unreadable, move on to the next one
+        pos = Position{Segment: w.segments[idx+1].id}
+    }
+}
+
+//Head returns the entry at the read position and the position after it; an entry of an older
+//version without a failure time gets the time its segment was last written
+func (w *WAL) Head() (*Entry, Position, error) {
+    pos := w.Position()
+    data, next, err := w.Read(pos)
+    if err != nil {
+        return nil, next, err
+    }
+    entry, err := Decode(data)
+    if err == nil && entry.Failed.IsZero() {
+        if info, serr := os.Stat(w.segmentPath(pos.Segment)); serr == nil {
+            entry.Failed = info.ModTime()
+        }
+    }
+    return entry, next, err
+}
+
+//Commit persists pos as the read position and removes segments that were fully consumed;
+//a position that is not ahead of the current one is ignored, so concurrent readers can not
+//move it back
+func (w *WAL) Commit(pos Position) error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    return w.commit(pos)
+}
+
+func (w *WAL) commit(pos Position) error {
+    if pos.Segment < w.state.Segment || (pos.Segment == w.state.Segment && pos.Offset <= w.state.Offset) {
+        return nil
+    }
+
+    if pos.Segment == w.state.Segment {
+        _, cnt, err := scanRange(w.segmentPath(pos.Segment), w.state.Offset, pos.Offset)
+        if err != nil {
+            return err
+        }
+        w.consumed += cnt
+    } else {
+        _, cnt, err := scanRange(w.segmentPath(pos.Segment), 0, pos.Offset)
+        if err != nil {
+            return err
+        }
+        w.consumed = cnt
+    }
+    w.state = state{Position: pos}
+
+    if err := w.saveState(); err != nil {
+        return err
+    }
+
+    return w.compact()
+}
+
+//Fail records a failed replay of the record at the read position and returns the attempts so far
+func (w *WAL) Fail(reason string) (int, error) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    w.state.Attempts++
+    w.state.Error = reason
+
+    return w.state.Attempts, w.saveState()
+}
+
+//SkipSegment drops every unread record of the segment at the read position, returning how many were dropped
+func (w *WAL) SkipSegment() (int, error) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    idx := w.index(w.state.Segment)
+    seg := w.segments[idx]
+    if seg.records == w.consumed {
+        return 0, nil
+    }
+    if idx == len(w.segments)-1 {
+        if w.file == nil {
+            return 0, errors.New("cache is closed")
+        }
+        if err := w.rotate(); err != nil {
+            return 0, err
+        }
+    }
+    dropped := seg.records - w.consumed
+
+    return dropped, w.commit(Position{Segment: w.segments[idx+1].id})
+}
+
+func (w *WAL) saveState() error {
+    if w.opts.ReadOnly {
+        return errReadOnly
+    }
+    data, err := json.Marshal(w.state)
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(filepath.Join(w.dir, offsetFile), data, w.opts.Fsync == "always")
+}
+
+//compact drops segments before the read position and rolls the active segment once it has been read entirely
+func (w *WAL) compact() error {
+    active := w.active()
+    if w.file != nil && w.state.Segment == active.id && w.state.Offset >= active.size && active.size > 0 {
+        if err := w.rotate(); err != nil {
+            return err
+        }
+        w.state = state{Position: Position{Segment: w.active().id}}
+        w.consumed = 0
+        if err := w.saveState(); err != nil {
+            return err
+        }
+    }
+
+    for len(w.segments) > 1 && w.segments[0].id < w.state.Segment {
+        if err := os.Remove(w.segmentPath(w.segments[0].id)); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        w.segments = w.segments[1:]
+    }
+
+    return nil
+}
+
+//Stats returns the number and size of unread records and the first failure time of the oldest one
+func (w *WAL) Stats() Stats {
+    w.mu.Lock()
+    stats := Stats{}
+    for _, seg := range w.segments[w.index(w.state.Segment):] {
+        stats.Entries += seg.records
+        stats.Bytes += seg.size
+        stats.Segments++
+    }
+    stats.Entries -= w.consumed
+    stats.Bytes -= w.state.Offset
+    w.mu.Unlock()
+
+    if stats.Entries > 0 {
+        if entry, _, err := w.Head(); err == nil {
+            stats.Oldest = entry.Failed
+        }
+    }
+
+    return stats
+}
+
+//Sync flushes the active segment to disk
+func (w *WAL) Sync() error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    if w.file == nil || !w.dirty {
+        return nil
+    }
+    w.dirty = false
+    return w.file.Sync()
+}
+
+func (w *WAL) syncLoop() {
+    interval := w.opts.FsyncInterval
+    if interval <= 0 {
+        interval = 1
+    }
+    ticker := time.NewTicker(interval * time.Second)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            if err := w.Sync(); err != nil {
+                logger.With(logger.Fields{"location":w.id}).Errorf("syncing cache segment: %s: %v", w.dir, err)
+            }
+        case <-w.closed:
+            return
+        }
+    }
+}
+
+//Close syncs and closes the active segment
+func (w *WAL) Close() error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    if w.file == nil {
+        return nil
+    }
+    close(w.closed)
+
+    err := w.file.Sync()
+    if cerr := w.file.Close(); err == nil {
+        err = cerr
+    }
+    w.file = nil
+
+    return err
+}
+
+//readRecord reads the record at offset and returns its payload and the offset following it
+func readRecord(path string, offset int64) ([]byte, int64, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, offset, err
+    }
+    defer file.Close()
+
+    return readAt(file, offset)
+}
+
+func readAt(file *os.File, offset int64) ([]byte, int64, error) {
+    size, err := readHeader(file, offset)
+    if err != nil {
+        return nil, offset, err
+    }
+
+    data := make([]byte, size+headerSize)
+    if _, err := file.ReadAt(data, offset); err != nil {
+        return nil, offset, errCorrupt
+    }
+    if crc32.Checksum(data[headerSize:], castagnoli) != binary.BigEndian.Uint32(data[4:8]) {
+        return nil, offset, errCorrupt
+    }
+
+    return data[headerSize:], offset + headerSize + int64(size), nil
+}
+
+//readSize returns the payload size of the record header data starts with
+func readSize(data []byte) (uint32, error) {
+    if len(data) < headerSize {
+        return 0, io.ErrUnexpectedEOF
+    }
+    size := binary.BigEndian.Uint32(data[0:4])
+    if size > maxRecord {
+        return 0, errCorrupt
+    }
+    return size, nil
+}
+
+func readHeader(file *os.File, offset int64) (uint32, error) {
+    header := make([]byte, headerSize)
+    if _, err := file.ReadAt(header, offset); err != nil {
+        if err == io.EOF {
+            info, serr := file.Stat()
+            if serr == nil && info.Size() > offset {
+                return 0, errCorrupt
+            }
+        }
+        return 0, err
+    }
+
+    size := binary.BigEndian.Uint32(header[0:4])
+    if size > maxRecord {
+        return 0, errCorrupt
+    }
+
+    return size, nil
+}
+
+//scanSegment returns the length and record count of the intact prefix of a segment, up to limit when it is not negative;
+//a torn tail is only expected, and reported, on the segment being written
+func scanSegment(path string, limit int64, tail bool) (int64, int, error) {
+    size, cnt, err := scanRange(path, 0, limit)
+    if err == errCorrupt {
+        if tail {
+            logger.Errorf("truncating torn cache segment: %s at %d", path, size)
+        }
+        return size, cnt, nil
+    }
+    return size, cnt, err
+}
+
+//scanRange walks record headers from offset up to limit (or the end when negative) and returns where it stopped
+//and how many records it passed
+func scanRange(path string, offset int64, limit int64) (int64, int, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return offset, 0, nil
+        }
+        return offset, 0, err
+    }
+    defer file.Close()
+
+    info, err := file.Stat()
+    if err != nil {
+        return offset, 0, err
+    }
+
+    cnt := 0
+    for limit < 0 || offset < limit {
+        size, err := readHeader(file, offset)
+        if err == io.EOF {
+            return offset, cnt, nil
+        }
+        if err != nil {
+            return offset, cnt, err
+        }
+        next := offset + headerSize + int64(size)
+        if next > info.Size() {
+            return offset, cnt, errCorrupt
+        }
+        if limit < 0 {
+            //only a full check of the payload tells a torn tail from a complete record
+            if _, _, err := readAt(file, offset); err != nil {
+                return offset, cnt, err
+            }
+        }
+        offset = next
+        cnt++
+    }
+
+    return offset, cnt, nil
+}
+
+func writeFileAtomic(path string, data []byte, sync bool) error {
+    tmp := path + ".tmp"
+
+    file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+    if _, err := file.Write(data); err != nil {
+        file.Close()
+        return err
+    }
+    if sync {
+        if err := file.Sync(); err != nil {
+            file.Close()
+            return err
+        }
+    }
+    if err := file.Close(); err != nil {
+        return err
+    }
+
+    return os.Rename(tmp, path)
+}
@@ -0,0 +1,208 @@
+package cache
+
+import (
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func openTestWAL(t *testing.T, dir string, size int64) *WAL {
+    w, err := OpenWAL(dir, Options{SegmentSize: size, Fsync: "never"})
+    if err != nil {
+        t.Fatalf("opening wal: %v", err)
+    }
+    return w
+}
+
+//readAll returns the records from the read position on
+func readAll(t *testing.T, w *WAL) []string {
+    var records []string
+    pos := w.Position()
+    for {
+        data, next, err := w.Read(pos)
+        if err == io.EOF {
+            return records
+        }
+        if err != nil {
+            t.Fatalf("reading wal: %v", err)
+        }
+        records = append(records, string(data))
+        pos = next
+    }
+}
+
+func TestWALAppendCommit(t *testing.T) {
+    dir, err := ioutil.TempDir("", "wal")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    //small segments, every record after the first one starts a new segment
+    w := openTestWAL(t, filepath.Join(dir, "main"), 16)
+    for _, record := range []string{"one", "two", "three"} {
+        if err := w.Append([]byte(record)); err != nil {
+            t.Fatalf("appending: %v", err)
+        }
+    }
+    if got := readAll(t, w); len(got) != 3 || got[0] != "one" || got[2] != "three" {
+        t.Fatalf("records = %q", got)
+    }
+
+    _, next, err := w.Read(w.Position())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := w.Commit(next); err != nil {
+        t.Fatalf("committing: %v", err)
+    }
+    if err := w.Commit(Position{Segment: 1}); err != nil {
+        t.Fatalf("committing an older position: %v", err)
+    }
+    if w.Position() != next {
+        t.Fatalf("position moved back to %+v, want %+v", w.Position(), next)
+    }
+    if st := w.Stats(); st.Entries != 2 {
+        t.Fatalf("entries = %d, want 2", st.Entries)
+    }
+    if err := w.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    w = openTestWAL(t, filepath.Join(dir, "main"), 16)
+    defer w.Close()
+    if got := readAll(t, w); len(got) != 2 || got[0] != "two" {
+        t.Fatalf("records after reopening = %q", got)
+    }
+}
+
+func TestWALTornSegment(t *testing.T) {
+    dir, err := ioutil.TempDir("", "wal")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    w := openTestWAL(t, dir, 0)
+    for _, record := range []string{"one", "two"} {
+        if err := w.Append([]byte(record)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    path := w.segmentPath(1)
+    if err := w.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    //a record header promising more bytes than were written, as a crash during a write leaves it
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, 'x'})
+    f.Close()
+
+    w = openTestWAL(t, dir, 0)
+    defer w.Close()
+    if got := readAll(t, w); len(got) != 2 || got[1] != "two" {
+        t.Fatalf("records = %q", got)
+    }
+    if err := w.Append([]byte("three")); err != nil {
+        t.Fatal(err)
+    }
+    if got := readAll(t, w); len(got) != 3 || got[2] != "three" {
+        t.Fatalf("records after appending = %q", got)
+    }
+}
+
+func TestWALSkipSegment(t *testing.T) {
+    dir, err := ioutil.TempDir("", "wal")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    w := openTestWAL(t, dir, 0)
+    defer w.Close()
+    for _, record := range []string{"one", "two"} {
+        if err := w.Append([]byte(record)); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    dropped, err := w.SkipSegment()
+    if err != nil || dropped != 2 {
+        t.Fatalf("SkipSegment() = %d, %v, want 2", dropped, err)
+    }
+    if got := readAll(t, w); len(got) != 0 {
+        t.Fatalf("records = %q", got)
+    }
+}
+
+func TestHeadLegacyEntry(t *testing.T) {
+    dir, err := ioutil.TempDir("", "wal")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    w := openTestWAL(t, dir, 0)
+    defer w.Close()
+    //a bare batch of an older version, without a failure time
+    if err := w.Append([]byte(`{"Urls":["http://127.0.0.1:8086/write"]}`)); err != nil {
+        t.Fatal(err)
+    }
+
+    entry, _, err := w.Head()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if entry.Failed.IsZero() || time.Since(entry.Failed) > time.Minute {
+        t.Fatalf("failed = %v, want the time of the segment", entry.Failed)
+    }
+}
+
+func TestWALQuarantine(t *testing.T) {
+    dir, err := ioutil.TempDir("", "wal")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    w := openTestWAL(t, dir, 0)
+    for _, record := range []string{"one", "two", "three"} {
+        if err := w.Append([]byte(record)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    path := w.segmentPath(1)
+    if err := w.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    //a flipped byte in the payload of the second record, with the third one intact behind it
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data[headerSize+3+headerSize] ^= 0xff
+    if err := ioutil.WriteFile(path, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    w = openTestWAL(t, dir, 0)
+    defer w.Close()
+    if got := readAll(t, w); len(got) != 1 || got[0] != "one" {
+        t.Fatalf("records = %q", got)
+    }
+    tail, err := ioutil.ReadFile(path + ".11.corrupt")
+    if err != nil {
+        t.Fatalf("reading the quarantined tail: %v", err)
+    }
+    if len(tail) != len(data)-11 {
+        t.Fatalf("quarantined %d bytes, want %d", len(tail), len(data)-11)
+    }
+}
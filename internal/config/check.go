@@ -0,0 +1,197 @@
+package config
+
+import (
+    "fmt"
+    "io/ioutil"
+    "net"
+    "net/url"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+)
+
+var (
+    //groupRegexp finds the group references of a replacement the way regexp.Expand reads them
+    groupRegexp = regexp.MustCompile(`\$(\$|\{([^}]*)\}|([A-Za-z0-9_]+))`)
+)
+
+//Problem is a finding of Check, Line is 0 when it can not be tied to a line of the file
+type Problem struct {
+    Line         int
+    Message      string
+}
+
+func (p Problem) String() string {
+    if p.Line == 0 {
+        return p.Message
+    }
+    return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+}
+
+//Check loads a config file and looks for the mistakes LoadConfigFile lets through: malformed
+//listen addresses and backend urls, replacements using groups their expression does not have
+//and cache directories that can not be written
+func Check(filename string) []Problem {
+    cfg, err := LoadConfigFile(filename)
+    if err != nil {
+        return []Problem{{Message: err.Error()}}
+    }
+
+    //the lines come from the file itself, the values of included files have none
+    var pos positions
+    if content, err := ioutil.ReadFile(filename); err == nil {
+        format := Format
+        if format == "" {
+            format = FormatOf(filename)
+        }
+        pos = locate(content, format)
+    }
+
+    var problems []Problem
+    add := func(path string, format string, args ...interface{}) {
+        problems = append(problems, Problem{Line: pos.line(path), Message: fmt.Sprintf(format, args...)})
+    }
+
+    if cfg.Cache.Enabled {
+        if err := checkDir(cfg.Cache.Directory); err != nil {
+            add("cache.directory", "cache directory: %v", err)
+        }
+    }
+    if cfg.Cache.Dead_letter != "" {
+        if err := checkDir(cfg.Cache.Dead_letter); err != nil {
+            add("cache.dead_letter", "dead-letter directory: %v", err)
+        }
+    }
+
+    for i, stream := range cfg.Write.Streams {
+        path := fmt.Sprintf("write.streams.%d", i)
+        if !pos.has(path) {
+            path = ""
+        }
+        at := func(keys ...interface{}) string {
+            if path == "" {
+                return ""
+            }
+            p := path
+            for _, key := range keys {
+                p += "." + fmt.Sprint(key)
+            }
+            return p
+        }
+
+        if _, _, err := net.SplitHostPort(stream.Listen); err != nil {
+            add(at("listen"), "invalid listen address %q: %v", stream.Listen, err)
+        }
+        if len(stream.Locations) == 0 {
+            add(at("locations"), "stream %q has no locations", stream.Listen)
+        }
+
+        for j, locat := range stream.Locations {
+            if len(locat.Urls) == 0 && locat.Archive == nil {
+                add(at("locations", j), "location %q has no urls", locat.ID())
+            }
+            if locat.Archive != nil && locat.Archive.Directory != "" {
+                if err := checkDir(locat.Archive.Directory); err != nil {
+                    add(at("locations", j, "archive", "directory"), "location %q: archive directory: %v", locat.ID(), err)
+                }
+            }
+            for k, rawurl := range locat.Urls {
+                if err := checkUrl(rawurl); err != nil {
+                    add(at("locations", j, "urls", k), "location %q: invalid url %q: %v", locat.ID(), rawurl, err)
+                }
+            }
+            for k, rexp := range locat.Regexp {
+                re, err := regexp.Compile(rexp.Match)
+                if err != nil {
+                    add(at("locations", j, "regexp", k, "match"), "location %q: invalid regexp %q: %v", locat.ID(), rexp.Match, err)
+                    continue
+                }
+                for _, group := range missingGroups(re, rexp.Replace) {
+                    add(at("locations", j, "regexp", k, "replace"), "location %q: replacement %q uses %s, %q has no such group", locat.ID(), rexp.Replace, group, rexp.Match)
+                }
+            }
+        }
+    }
+
+    return problems
+}
+
+//checkUrl accepts absolute http and https urls
+func checkUrl(rawurl string) error {
+    u, err := url.Parse(rawurl)
+    if err != nil {
+        return err
+    }
+    if u.Scheme != "http" && u.Scheme != "https" {
+        return fmt.Errorf("scheme must be http or https")
+    }
+    if u.Host == "" {
+        return fmt.Errorf("missing host")
+    }
+    return nil
+}
+
+//missingGroups returns the references of a replacement to groups the expression does not have,
+//they silently expand to nothing
+func missingGroups(re *regexp.Regexp, replace string) []string {
+    names := make(map[string]bool)
+    for _, name := range re.SubexpNames() {
+        if name != "" {
+            names[name] = true
+        }
+    }
+
+    var missing []string
+    for _, m := range groupRegexp.FindAllStringSubmatch(replace, -1) {
+        if m[1] == "$" {
+            continue
+        }
+        name := m[2] + m[3]
+        if n, err := strconv.Atoi(name); err == nil {
+            if n > re.NumSubexp() {
+                missing = append(missing, m[0])
+            }
+            continue
+        }
+        if !names[name] {
+            missing = append(missing, m[0])
+        }
+    }
+
+    return missing
+}
+
+//checkDir makes sure a directory accepts new files, or the closest existing parent when the
+//server still has to create it
+func checkDir(dir string) error {
+    if dir == "" {
+        return fmt.Errorf("not set")
+    }
+
+    for {
+        info, err := os.Stat(dir)
+        if err == nil {
+            if !info.IsDir() {
+                return fmt.Errorf("%s is not a directory", dir)
+            }
+            break
+        }
+        if !os.IsNotExist(err) {
+            return err
+        }
+        parent := filepath.Dir(dir)
+        if parent == dir {
+            return err
+        }
+        dir = parent
+    }
+
+    file, err := ioutil.TempFile(dir, ".check-")
+    if err != nil {
+        return err
+    }
+    file.Close()
+
+    return os.Remove(file.Name())
+}
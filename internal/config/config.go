@@ -3,39 +3,275 @@ package config
 import (
     "time"
     //"log"
+    "fmt"
     "io/ioutil"
+    "os"
     "regexp"
-    "gopkg.in/yaml.v2"
+    "strings"
+    "path/filepath"
+    "crypto/md5"
+    "encoding/hex"
+)
+
+var (
+    nameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+    statusRegexp = regexp.MustCompile(`^[1-5]([0-9]{2}|xx)$`)
+    functionRegexp = regexp.MustCompile(`^(min|max|mean|sum|count|last|p(100|[1-9]?[0-9](\.[0-9]+)?))$`)
 )
 
 type Config struct {
+    Include          []string
     Cache struct {
         Enabled          bool
         Directory        string
         Wait             time.Duration
         Batch_cnt        int
+        Segment_size     int64
+        Fsync            string
+        Fsync_interval   time.Duration
+        Max_bytes        int64
+        Max_entries      int
+        Max_age          time.Duration
+        Min_free_bytes   int64
+        Eviction         string
+        Max_attempts     int
+        Dead_letter      string
+        Concurrency      int
+        Rate             int64
+        Probe            string
     }
     Write struct {
         Timeout          time.Duration
         Repeat           int
         Delay_time       time.Duration
-        Streams []struct {
-            Listen       string
-            Locations    []Location
-        }
+        Retry            *Retry
+        Breaker          *Breaker
+        Health_check     *Health_check
+        Shutdown_timeout time.Duration
+        Drain_timeout    time.Duration
+        Streams          []Stream
     }
     Monit struct {
         Listen           string
+        Admin_token      string
+        Admin_token_file string
+        Client_label     string
+        Client_cidr_v4   int
+        Client_cidr_v6   int
+        Self_monitor     *Self_monitor
     }
 }
 
+type Stream struct {
+    Listen       string
+    Validation   string
+    Ack          string
+    Ack_timeout  time.Duration
+    Access_log   *Access_log
+    Freshness    *Freshness
+    Timestamp_guard *Timestamp_guard
+    Locations    []Location
+}
+
+//Access_log records every request of a stream, into file or the server log when it is empty
+type Access_log struct {
+    File             string
+}
+
 type Location struct {
+    Name         string
     Urls         []string
+    Username     string
+    Password     string
+    Password_file string
+    Tls          *Tls
     Cache        bool
-    Regexp       []struct {
-        Match        string
-        Replace      string
+    Timeout      time.Duration
+    Repeat       int
+    Delay_time   time.Duration
+    Retry        *Retry
+    Breaker      *Breaker
+    Health_check *Health_check
+    Timestamp_guard *Timestamp_guard
+    Enrich       *Enrich
+    Aggregate    *Aggregate
+    Redact       []Redact
+    Archive      *Archive
+    Regexp       []Rewrite
+}
+
+//Rewrite replaces the parts of the lines of a location matching an expression
+type Rewrite struct {
+    Match        string
+    //${name} in a replacement is a group of the match, never an environment variable
+    Replace      string      `env:"-"`
+    re           *regexp.Regexp
+}
+
+//Compile compiles the expression of the rewrite, loading a config does it for every rewrite
+func (r *Rewrite) Compile() error {
+    re, err := regexp.Compile(r.Match)
+    if err != nil {
+        return err
+    }
+    r.re = re
+    return nil
+}
+
+//Regexp returns the compiled expression of the rewrite, nil before Compile
+func (r *Rewrite) Regexp() *regexp.Regexp {
+    return r.re
+}
+
+//Self_monitor writes the metrics of the server every interval seconds into the named location
+type Self_monitor struct {
+    Interval         time.Duration
+    Location         string
+    Database         string
+    Retention_policy string
+}
+
+//Freshness sets how many seconds ahead of or behind the receive time a point counts as in the future
+//or late, and the measurements whose ingest delay is exported on their own
+type Freshness struct {
+    Future           time.Duration
+    Late             time.Duration
+    Measurements     []string
+}
+
+//Timestamp_guard handles the points dated more than max_future seconds ahead of or max_past seconds
+//behind their receipt, 0 leaving that side open: drop them, clamp them to the receive time or reroute
+//them to the quarantine location; offenders are logged once per client every log_interval seconds
+type Timestamp_guard struct {
+    Max_future       time.Duration
+    Max_past         time.Duration
+    Action           string
+    Location         string
+    Log_interval     time.Duration
+}
+
+//Enrich adds tags to the points of a location after its rewrites: static ones, the client address
+//and the columns of lookup tables; tags a point already has are kept
+type Enrich struct {
+    Tags             map[string]string
+    Client_tag       string
+    Lookups          []Lookup
+}
+
+//Lookup adds the other columns of the row of a csv or json file whose key columns match the tags
+//of a point, or the default tags when none does; the file is checked for changes every reload seconds
+type Lookup struct {
+    File             string
+    Keys             []string
+    Default          map[string]string
+    Reload           time.Duration
+}
+
+//Aggregate rolls the numeric fields of the points of a location up per series over tumbling windows
+//of period seconds, after the rewrites and the enrichment; a window is sent grace seconds after its end
+//and later points for it are dropped; the raw points are sent as well with pass_through
+type Aggregate struct {
+    Period           time.Duration
+    Grace            time.Duration
+    Functions        []string
+    Output           string
+    Suffix           string
+    Pass_through     bool
+}
+
+//Redact replaces the values of the listed tags and string fields, and the parts of tag and string field
+//values matching pattern, after the enrichment: with a keyed hmac (hex, cut to length digits when set),
+//a truncation of ip addresses to their network (other values are cut to length characters) or the mask
+type Redact struct {
+    Tags             []string
+    Fields           []string
+    Pattern          string
+    Method           string
+    Key              string
+    Key_file         string
+    Length           int
+    Prefix_v4        int
+    Prefix_v6        int
+    Mask             string
+    pattern          *regexp.Regexp
+}
+
+//Compile compiles the pattern of the rule when it has one, loading a config does it for every rule
+func (r *Redact) Compile() error {
+    if r.Pattern == "" {
+        r.pattern = nil
+        return nil
+    }
+    re, err := regexp.Compile(r.Pattern)
+    if err != nil {
+        return err
+    }
+    r.pattern = re
+    return nil
+}
+
+//Regexp returns the compiled pattern of the rule, nil without one or before Compile
+func (r *Redact) Regexp() *regexp.Regexp {
+    return r.pattern
+}
+
+//Archive writes the points of a location into local files instead of sending them to urls, below
+//directory/<db>/<date>; a file is rotated after max_size bytes or rotate seconds, gzip compressed
+//with compress, and removed retention seconds after its last write (0 keeps it)
+type Archive struct {
+    Directory        string
+    Max_size         int64
+    Rotate           time.Duration
+    Compress         bool
+    Retention        time.Duration
+}
+
+//Tls sets up the connections to the backend urls of a location
+type Tls struct {
+    Ca_file      string
+    Cert_file    string
+    Key_file     string
+    Server_name  string
+    Insecure_skip_verify bool
+}
+
+//Breaker stops sending to a backend url after failures in a row until cool_down seconds passed
+type Breaker struct {
+    Failures         int
+    Cool_down        time.Duration
+}
+
+//Health_check polls path on the host of every backend url; intervals are in seconds
+type Health_check struct {
+    Path             string
+    Interval         time.Duration
+    Timeout          time.Duration
+    Healthy          int
+    Unhealthy        int
+}
+
+//Retry replaces the fixed repeat and delay_time with exponential backoff; intervals are in seconds
+type Retry struct {
+    Max_retries      int
+    Initial_interval time.Duration
+    Max_interval     time.Duration
+    Multiplier       float64
+    Max_elapsed      time.Duration
+    Statuses         []string
+}
+
+//ID identifies the location in the cache, by name or else by its urls or archive directory
+func (l Location) ID() string {
+    if l.Name != "" {
+        return l.Name
+    }
+    key := strings.Join(l.Urls, ",")
+    if key == "" && l.Archive != nil {
+        key = "archive:" + l.Archive.Directory
     }
+    hasher := md5.New()
+    hasher.Write([]byte(key))
+    return hex.EncodeToString(hasher.Sum(nil))
 }
 
 func LoadConfigFile(filename string) (*Config, error) {
@@ -46,16 +282,154 @@ func LoadConfigFile(filename string) (*Config, error) {
        return cfg, err
     }
 
-    if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+    format := Format
+    if format == "" {
+        format = FormatOf(filename)
+    }
+    if err := decode(content, format, cfg); err != nil {
         return cfg, err
     }
+    expand(cfg)
+    resolveLookups(cfg.Write.Streams, filepath.Dir(filename))
 
-    for _, stream := range cfg.Write.Streams {
-        for _, locat := range stream.Locations {
-            for _, rexp := range locat.Regexp {
-                _, err = regexp.Compile(rexp.Match)
-                if err != nil {
-                    return cfg, err
+    if err := include(cfg, filepath.Dir(filename)); err != nil {
+        return cfg, err
+    }
+
+    switch cfg.Monit.Client_label {
+    case "":
+        cfg.Monit.Client_label = "cidr"
+    case "ip", "cidr", "off":
+    default:
+        return cfg, fmt.Errorf("unknown monit client_label %q, expected ip, cidr or off", cfg.Monit.Client_label)
+    }
+    if cfg.Monit.Client_cidr_v4 == 0 {
+        cfg.Monit.Client_cidr_v4 = 24
+    }
+    if cfg.Monit.Client_cidr_v6 == 0 {
+        cfg.Monit.Client_cidr_v6 = 64
+    }
+    if cfg.Monit.Client_cidr_v4 < 0 || cfg.Monit.Client_cidr_v4 > 32 || cfg.Monit.Client_cidr_v6 < 0 || cfg.Monit.Client_cidr_v6 > 128 {
+        return cfg, fmt.Errorf("invalid monit client_cidr_v4 or client_cidr_v6")
+    }
+
+    if err := checkSelfMonitor(cfg); err != nil {
+        return cfg, err
+    }
+
+    if err := readSecret(&cfg.Monit.Admin_token, cfg.Monit.Admin_token_file); err != nil {
+        return cfg, fmt.Errorf("monit admin token: %v", err)
+    }
+
+    if cfg.Cache.Batch_cnt == 0 {
+        cfg.Cache.Batch_cnt = 1000
+    }
+    if cfg.Cache.Segment_size == 0 {
+        cfg.Cache.Segment_size = 64 << 20
+    }
+    switch cfg.Cache.Fsync {
+    case "":
+        cfg.Cache.Fsync = "interval"
+    case "always", "interval", "never":
+    default:
+        return cfg, fmt.Errorf("unknown cache fsync policy %q", cfg.Cache.Fsync)
+    }
+    if cfg.Cache.Probe == "" {
+        cfg.Cache.Probe = "/ping"
+    }
+
+    switch cfg.Cache.Eviction {
+    case "":
+        cfg.Cache.Eviction = "oldest"
+    case "oldest", "fair_share":
+    default:
+        return cfg, fmt.Errorf("unknown cache eviction policy %q", cfg.Cache.Eviction)
+    }
+
+    if cfg.Write.Shutdown_timeout == 0 {
+        cfg.Write.Shutdown_timeout = 10
+    }
+    if cfg.Write.Drain_timeout == 0 {
+        cfg.Write.Drain_timeout = 30
+    }
+
+    if err := checkRetry(cfg.Write.Retry); err != nil {
+        return cfg, err
+    }
+    if err := checkBreaker(cfg.Write.Breaker); err != nil {
+        return cfg, err
+    }
+    checkHealth(cfg.Write.Health_check)
+
+    listens := make(map[string]bool)
+    if cfg.Monit.Listen != "" {
+        listens[cfg.Monit.Listen] = true
+    }
+    names := make(map[string]bool)
+    for n, stream := range cfg.Write.Streams {
+        if listens[stream.Listen] {
+            return cfg, fmt.Errorf("listen address %q is used twice", stream.Listen)
+        }
+        listens[stream.Listen] = true
+        if stream.Freshness == nil {
+            cfg.Write.Streams[n].Freshness = &Freshness{}
+        }
+        checkFreshness(cfg.Write.Streams[n].Freshness)
+        if err := checkGuard(cfg, stream.Timestamp_guard); err != nil {
+            return cfg, fmt.Errorf("%v (%s)", err, stream.Listen)
+        }
+        switch stream.Validation {
+        case "", "passthrough", "drop_invalid", "reject":
+        default:
+            return cfg, fmt.Errorf("unknown validation mode %q (%s)", stream.Validation, stream.Listen)
+        }
+        switch stream.Ack {
+        case "", "async", "any", "quorum", "all", "durable":
+        default:
+            return cfg, fmt.Errorf("unknown ack policy %q (%s)", stream.Ack, stream.Listen)
+        }
+        for i, locat := range stream.Locations {
+            //names become directory and file names of the cache and the archives
+            if locat.Name != "" && (!nameRegexp.MatchString(locat.Name) || strings.Contains(locat.Name, "..")) {
+                return cfg, fmt.Errorf("invalid location name %q", locat.Name)
+            }
+            if locat.Name != "" {
+                if names[locat.Name] {
+                    return cfg, fmt.Errorf("location name %q is used twice", locat.Name)
+                }
+                names[locat.Name] = true
+            }
+            if err := readSecrets(&stream.Locations[i]); err != nil {
+                return cfg, err
+            }
+            if _, err := locat.Tls.Config(); err != nil {
+                return cfg, fmt.Errorf("location %q: %v", locat.ID(), err)
+            }
+            if err := checkRetry(locat.Retry); err != nil {
+                return cfg, err
+            }
+            if err := checkBreaker(locat.Breaker); err != nil {
+                return cfg, err
+            }
+            checkHealth(locat.Health_check)
+            if err := checkGuard(cfg, locat.Timestamp_guard); err != nil {
+                return cfg, fmt.Errorf("location %q: %v", locat.ID(), err)
+            }
+            if err := checkEnrich(locat.Enrich); err != nil {
+                return cfg, fmt.Errorf("location %q: %v", locat.ID(), err)
+            }
+            if err := checkAggregate(locat.Aggregate); err != nil {
+                return cfg, fmt.Errorf("location %q: %v", locat.ID(), err)
+            }
+            if err := checkRedact(locat.Redact); err != nil {
+                return cfg, fmt.Errorf("location %q: %v", locat.ID(), err)
+            }
+            if err := checkArchive(locat.Archive); err != nil {
+                return cfg, fmt.Errorf("location %q: %v", locat.ID(), err)
+            }
+            for j := range locat.Regexp {
+                if err := locat.Regexp[j].Compile(); err != nil {
+                    return cfg, fmt.Errorf("location %q: regexp %q: %v", locat.ID(), locat.Regexp[j].Match, err)
                 }
             }
         }
@@ -63,3 +437,236 @@ func LoadConfigFile(filename string) (*Config, error) {
 
     return cfg, nil
 }
+
+//checkSelfMonitor fills in the defaults of the self_monitor section and checks its location exists
+func checkSelfMonitor(cfg *Config) error {
+    sm := cfg.Monit.Self_monitor
+    if sm == nil {
+        return nil
+    }
+    if sm.Interval <= 0 {
+        sm.Interval = 60
+    }
+    if sm.Database == "" {
+        sm.Database = "relay_server"
+    }
+    if _, ok := cfg.Location(sm.Location); !ok {
+        return fmt.Errorf("self_monitor location %q is not configured", sm.Location)
+    }
+    return nil
+}
+
+//checkGuard fills in the defaults of a timestamp guard and checks its quarantine location exists
+func checkGuard(cfg *Config, g *Timestamp_guard) error {
+    if g == nil {
+        return nil
+    }
+    if g.Log_interval <= 0 {
+        g.Log_interval = 60
+    }
+    switch g.Action {
+    case "":
+        g.Action = "drop"
+    case "drop", "clamp":
+    case "reroute":
+        if _, ok := cfg.Location(g.Location); !ok {
+            return fmt.Errorf("timestamp_guard location %q is not configured", g.Location)
+        }
+    default:
+        return fmt.Errorf("unknown timestamp_guard action %q", g.Action)
+    }
+    return nil
+}
+
+//checkEnrich fills in the reload interval of the lookup tables and checks their files exist
+func checkEnrich(e *Enrich) error {
+    if e == nil {
+        return nil
+    }
+    for i := range e.Lookups {
+        lookup := &e.Lookups[i]
+        if len(lookup.Keys) == 0 {
+            return fmt.Errorf("lookup %q has no keys", lookup.File)
+        }
+        switch strings.ToLower(filepath.Ext(lookup.File)) {
+        case ".csv", ".json":
+        default:
+            return fmt.Errorf("lookup %q is neither a csv nor a json file", lookup.File)
+        }
+        if _, err := os.Stat(lookup.File); err != nil {
+            return fmt.Errorf("lookup: %v", err)
+        }
+        if lookup.Reload <= 0 {
+            lookup.Reload = 30
+        }
+    }
+    return nil
+}
+
+//checkAggregate fills in the defaults of an aggregate section and checks its functions
+func checkAggregate(a *Aggregate) error {
+    if a == nil {
+        return nil
+    }
+    if a.Period <= 0 {
+        a.Period = 60
+    }
+    if a.Grace < 0 {
+        a.Grace = 0
+    }
+    if len(a.Functions) == 0 {
+        a.Functions = []string{"mean"}
+    }
+    for _, function := range a.Functions {
+        if !functionRegexp.MatchString(function) {
+            return fmt.Errorf("unknown aggregate function %q, use min, max, mean, sum, count, last or p0 to p100", function)
+        }
+    }
+    switch a.Output {
+    case "":
+        a.Output = "fields"
+    case "fields", "measurements":
+    default:
+        return fmt.Errorf("unknown aggregate output %q, use fields or measurements", a.Output)
+    }
+    return nil
+}
+
+//checkRedact fills in the defaults of the redact rules, their secrets were read with the location
+func checkRedact(rules []Redact) error {
+    for i := range rules {
+        rule := &rules[i]
+        if len(rule.Tags) == 0 && len(rule.Fields) == 0 && rule.Pattern == "" {
+            return fmt.Errorf("redact rule %d has no tags, fields or pattern", i + 1)
+        }
+        if err := rule.Compile(); err != nil {
+            return fmt.Errorf("redact rule %d: %v", i + 1, err)
+        }
+        switch rule.Method {
+        case "":
+            rule.Method = "hmac"
+        case "hmac", "truncate", "mask":
+        default:
+            return fmt.Errorf("unknown redact method %q, use hmac, truncate or mask", rule.Method)
+        }
+        if rule.Method == "hmac" && rule.Key == "" {
+            return fmt.Errorf("redact rule %d needs a key or key_file for hmac", i + 1)
+        }
+        if rule.Length < 0 {
+            rule.Length = 0
+        }
+        if rule.Prefix_v4 <= 0 || rule.Prefix_v4 > 32 {
+            rule.Prefix_v4 = 24
+        }
+        if rule.Prefix_v6 <= 0 || rule.Prefix_v6 > 128 {
+            rule.Prefix_v6 = 48
+        }
+        if rule.Mask == "" {
+            rule.Mask = "redacted"
+        }
+    }
+    return nil
+}
+
+//checkArchive fills in the defaults of an archive section
+func checkArchive(a *Archive) error {
+    if a == nil {
+        return nil
+    }
+    if a.Directory == "" {
+        return fmt.Errorf("archive has no directory")
+    }
+    if a.Max_size <= 0 {
+        a.Max_size = 100 << 20
+    }
+    if a.Rotate <= 0 {
+        a.Rotate = 3600
+    }
+    if a.Retention < 0 {
+        a.Retention = 0
+    }
+    return nil
+}
+
+//Location returns the location with the given name or id
+func (c *Config) Location(id string) (Location, bool) {
+    for _, stream := range c.Write.Streams {
+        for _, locat := range stream.Locations {
+            if id != "" && locat.ID() == id {
+                return locat, true
+            }
+        }
+    }
+    return Location{}, false
+}
+
+//checkBreaker fills in the cool-down of a breaker section
+func checkBreaker(breaker *Breaker) error {
+    if breaker == nil {
+        return nil
+    }
+    if breaker.Failures < 0 || breaker.Cool_down < 0 {
+        return fmt.Errorf("invalid breaker, failures and cool_down must not be negative")
+    }
+    if breaker.Cool_down == 0 {
+        breaker.Cool_down = 30
+    }
+    return nil
+}
+
+//checkFreshness fills in the future and late limits of a freshness section
+func checkFreshness(f *Freshness) {
+    if f.Future <= 0 {
+        f.Future = 60
+    }
+    if f.Late <= 0 {
+        f.Late = 3600
+    }
+}
+
+//checkHealth fills in the defaults of a health check section
+func checkHealth(hc *Health_check) {
+    if hc == nil {
+        return
+    }
+    if hc.Path == "" {
+        hc.Path = "/ping"
+    }
+    if hc.Interval <= 0 {
+        hc.Interval = 10
+    }
+    if hc.Timeout <= 0 {
+        hc.Timeout = 2
+    }
+    if hc.Healthy <= 0 {
+        hc.Healthy = 1
+    }
+    if hc.Unhealthy <= 0 {
+        hc.Unhealthy = 3
+    }
+}
+
+//checkRetry fills in the defaults of a retry section and validates its statuses
+func checkRetry(retry *Retry) error {
+    if retry == nil {
+        return nil
+    }
+    if retry.Initial_interval == 0 {
+        retry.Initial_interval = 1
+    }
+    if retry.Max_interval == 0 {
+        retry.Max_interval = 30
+    }
+    if retry.Multiplier == 0 {
+        retry.Multiplier = 2
+    }
+    if len(retry.Statuses) == 0 {
+        retry.Statuses = []string{"408", "429", "5xx"}
+    }
+    for _, status := range retry.Statuses {
+        if !statusRegexp.MatchString(status) {
+            return fmt.Errorf("invalid retry status %q, expected a code like 429 or a class like 5xx", status)
+        }
+    }
+    return nil
+}
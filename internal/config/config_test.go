@@ -0,0 +1,126 @@
+package config
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+    dir, err := ioutil.TempDir("", "config")
+    if err != nil {
+        t.Fatal(err)
+    }
+    file := filepath.Join(dir, "relay.yml")
+    if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    return file
+}
+
+func TestDuplicates(t *testing.T) {
+    configs := map[string]string{
+        "listen": `
+monit:
+  listen: ":7086"
+write:
+  streams:
+    - listen: ":7086"
+      locations:
+        - urls: ["http://127.0.0.1:8086/write"]
+`,
+        "location name": `
+write:
+  streams:
+    - listen: ":7086"
+      locations:
+        - name: "main"
+          urls: ["http://127.0.0.1:8086/write"]
+    - listen: ":7087"
+      locations:
+        - name: "main"
+          urls: ["http://127.0.0.1:8087/write"]
+`,
+    }
+    for what, content := range configs {
+        file := writeConfig(t, content)
+        if _, err := LoadConfigFile(file); err == nil || !strings.Contains(err.Error(), "used twice") {
+            t.Errorf("duplicate %s: %v", what, err)
+        }
+        os.RemoveAll(filepath.Dir(file))
+    }
+}
+
+func TestCompileOnLoad(t *testing.T) {
+    configs := map[string]string{
+        "rewrite": `
+write:
+  streams:
+    - listen: ":7086"
+      locations:
+        - urls: ["http://127.0.0.1:8086/write"]
+          regexp:
+            - match: "cpu("
+              replace: "x"
+`,
+        "redact": `
+write:
+  streams:
+    - listen: ":7086"
+      locations:
+        - urls: ["http://127.0.0.1:8086/write"]
+          redact:
+            - pattern: "[a-"
+              method: "mask"
+`,
+    }
+    for what, content := range configs {
+        file := writeConfig(t, content)
+        if _, err := LoadConfigFile(file); err == nil {
+            t.Errorf("invalid %s expression loaded", what)
+        }
+        os.RemoveAll(filepath.Dir(file))
+    }
+
+    file := writeConfig(t, `
+write:
+  streams:
+    - listen: ":7086"
+      locations:
+        - urls: ["http://127.0.0.1:8086/write"]
+          regexp:
+            - match: "cpu"
+              replace: "load"
+          redact:
+            - pattern: "[a-z]+@example.com"
+              method: "mask"
+`)
+    defer os.RemoveAll(filepath.Dir(file))
+    cfg, err := LoadConfigFile(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    locat := cfg.Write.Streams[0].Locations[0]
+    if locat.Regexp[0].Regexp() == nil || locat.Redact[0].Regexp() == nil {
+        t.Errorf("expressions are not compiled on load")
+    }
+}
+
+func TestLocationName(t *testing.T) {
+    for _, name := range []string{"../main", "a/b", "..", ".hidden", "a..b"} {
+        file := writeConfig(t, `
+write:
+  streams:
+    - listen: ":7086"
+      locations:
+        - name: "` + name + `"
+          urls: ["http://127.0.0.1:8086/write"]
+`)
+        if _, err := LoadConfigFile(file); err == nil || !strings.Contains(err.Error(), "invalid location name") {
+            t.Errorf("name %q: %v", name, err)
+        }
+        os.RemoveAll(filepath.Dir(file))
+    }
+}
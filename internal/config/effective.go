@@ -0,0 +1,99 @@
+package config
+
+import (
+    "fmt"
+    "reflect"
+    "sort"
+    "strings"
+    "time"
+    "gopkg.in/yaml.v2"
+)
+
+const redacted = "<redacted>"
+
+//Redacted returns a copy of the config without secrets
+func (c *Config) Redacted() *Config {
+    cfg := *c
+    if cfg.Monit.Admin_token != "" {
+        cfg.Monit.Admin_token = redacted
+    }
+    cfg.Write.Streams = make([]Stream, len(c.Write.Streams))
+    for i, stream := range c.Write.Streams {
+        stream.Locations = append([]Location(nil), stream.Locations...)
+        for k := range stream.Locations {
+            if stream.Locations[k].Password != "" {
+                stream.Locations[k].Password = redacted
+            }
+            rules := append([]Redact(nil), stream.Locations[k].Redact...)
+            for r := range rules {
+                if rules[r].Key != "" {
+                    rules[r].Key = redacted
+                }
+            }
+            stream.Locations[k].Redact = rules
+        }
+        cfg.Write.Streams[i] = stream
+    }
+    return &cfg
+}
+
+//Marshal returns the config in a config file format, with durations in seconds and every default filled in
+func (c *Config) Marshal(format string) ([]byte, error) {
+    return Encode(Tree(c), format)
+}
+
+//Tree turns a config value into maps, slices and scalars keyed the way the config file is;
+//nil pointers and empty slices are left out
+func Tree(v interface{}) interface{} {
+    return tree(reflect.ValueOf(v))
+}
+
+func tree(v reflect.Value) interface{} {
+    if v.Type() == reflect.TypeOf(time.Duration(0)) {
+        return v.Int()
+    }
+
+    switch v.Kind() {
+    case reflect.Ptr, reflect.Interface:
+        if v.IsNil() {
+            return nil
+        }
+        return tree(v.Elem())
+    case reflect.Struct:
+        m := yaml.MapSlice{}
+        for i := 0; i < v.NumField(); i++ {
+            field := v.Type().Field(i)
+            if field.PkgPath != "" {
+                continue
+            }
+            value := tree(v.Field(i))
+            if value == nil {
+                continue
+            }
+            m = append(m, yaml.MapItem{Key: strings.ToLower(field.Name), Value: value})
+        }
+        return m
+    case reflect.Map:
+        if v.Len() == 0 {
+            return nil
+        }
+        keys := v.MapKeys()
+        sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+        m := yaml.MapSlice{}
+        for _, key := range keys {
+            m = append(m, yaml.MapItem{Key: fmt.Sprint(key), Value: tree(v.MapIndex(key))})
+        }
+        return m
+    case reflect.Slice:
+        if v.Len() == 0 {
+            return nil
+        }
+        list := make([]interface{}, v.Len())
+        for i := range list {
+            list[i] = tree(v.Index(i))
+        }
+        return list
+    }
+
+    return v.Interface()
+}
@@ -0,0 +1,202 @@
+package config
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "github.com/BurntSushi/toml"
+    "gopkg.in/yaml.v2"
+)
+
+//Format is the format of the config file, set from the command line; when empty it is
+//told by the file extension, included files always go by their extension
+var Format string
+
+//FormatOf returns the format of a config file: yaml, toml or json
+func FormatOf(filename string) string {
+    switch strings.ToLower(filepath.Ext(filename)) {
+    case ".toml":
+        return "toml"
+    case ".json":
+        return "json"
+    }
+    return "yaml"
+}
+
+//decode reads content into v, keys v does not have are errors in every format
+func decode(content []byte, format string, v interface{}) error {
+    switch format {
+    case "yaml", "yml":
+        return yaml.UnmarshalStrict(content, v)
+    case "toml":
+        md, err := toml.Decode(string(content), v)
+        if err != nil {
+            return err
+        }
+        if undecoded := md.Undecoded(); len(undecoded) > 0 {
+            keys := make([]string, len(undecoded))
+            for i, key := range undecoded {
+                keys[i] = key.String()
+            }
+            return fmt.Errorf("unknown keys: %s", strings.Join(keys, ", "))
+        }
+        return nil
+    case "json":
+        dec := json.NewDecoder(bytes.NewReader(content))
+        dec.DisallowUnknownFields()
+        return dec.Decode(v)
+    }
+    return fmt.Errorf("unknown config format %q", format)
+}
+
+//Decode reads a config file of any format into maps, slices and scalars, for conversion
+func Decode(content []byte, format string) (interface{}, error) {
+    var tree interface{}
+    switch format {
+    case "yaml", "yml":
+        var slice yaml.MapSlice
+        if err := yaml.Unmarshal(content, &slice); err != nil {
+            return nil, err
+        }
+        tree = slice
+    case "toml":
+        if _, err := toml.Decode(string(content), &tree); err != nil {
+            return nil, err
+        }
+    case "json":
+        dec := json.NewDecoder(bytes.NewReader(content))
+        dec.UseNumber()
+        if err := dec.Decode(&tree); err != nil {
+            return nil, err
+        }
+    default:
+        return nil, fmt.Errorf("unknown config format %q", format)
+    }
+    return coerce(normalize(tree, true), reflect.TypeOf(Config{})), nil
+}
+
+//coerce makes the numbers of a tree floats where the config expects them, toml tells the two apart
+func coerce(v interface{}, t reflect.Type) interface{} {
+    for t.Kind() == reflect.Ptr {
+        t = t.Elem()
+    }
+
+    switch v := v.(type) {
+    case yaml.MapSlice:
+        if t.Kind() != reflect.Struct {
+            return v
+        }
+        for i, item := range v {
+            if field, ok := t.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, fmt.Sprint(item.Key)) }); ok {
+                v[i].Value = coerce(item.Value, field.Type)
+            }
+        }
+    case []interface{}:
+        if t.Kind() != reflect.Slice {
+            return v
+        }
+        for i, value := range v {
+            v[i] = coerce(value, t.Elem())
+        }
+    case int64:
+        if t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64 {
+            return float64(v)
+        }
+    }
+
+    return v
+}
+
+//Encode writes a tree returned by Decode or Tree in a format
+func Encode(tree interface{}, format string) ([]byte, error) {
+    switch format {
+    case "yaml", "yml":
+        return yaml.Marshal(normalize(tree, true))
+    case "toml":
+        var buf bytes.Buffer
+        if err := toml.NewEncoder(&buf).Encode(normalize(tree, false)); err != nil {
+            return nil, err
+        }
+        return buf.Bytes(), nil
+    case "json":
+        content, err := json.MarshalIndent(normalize(tree, false), "", "  ")
+        if err != nil {
+            return nil, err
+        }
+        return append(content, '\n'), nil
+    }
+    return nil, fmt.Errorf("unknown config format %q", format)
+}
+
+//normalize turns numbers into int64 or float64 and the maps of every decoder into map[string]interface{},
+//or yaml.MapSlice to keep their order; empty values are dropped, toml has no way to write them
+func normalize(v interface{}, ordered bool) interface{} {
+    switch v := v.(type) {
+    case yaml.MapSlice:
+        if ordered {
+            m := make(yaml.MapSlice, 0, len(v))
+            for _, item := range v {
+                if value := normalize(item.Value, ordered); value != nil {
+                    m = append(m, yaml.MapItem{Key: fmt.Sprint(item.Key), Value: value})
+                }
+            }
+            return m
+        }
+        m := make(map[string]interface{}, len(v))
+        for _, item := range v {
+            if value := normalize(item.Value, ordered); value != nil {
+                m[fmt.Sprint(item.Key)] = value
+            }
+        }
+        return m
+    case map[interface{}]interface{}:
+        m := make(map[string]interface{}, len(v))
+        for key, value := range v {
+            if value = normalize(value, ordered); value != nil {
+                m[fmt.Sprint(key)] = value
+            }
+        }
+        return m
+    case map[string]interface{}:
+        m := make(map[string]interface{}, len(v))
+        for key, value := range v {
+            if value = normalize(value, ordered); value != nil {
+                m[key] = value
+            }
+        }
+        return m
+    case []interface{}:
+        list := make([]interface{}, 0, len(v))
+        for _, value := range v {
+            if value = normalize(value, ordered); value != nil {
+                list = append(list, value)
+            }
+        }
+        return list
+    case []map[string]interface{}:
+        list := make([]interface{}, 0, len(v))
+        for _, value := range v {
+            list = append(list, normalize(value, ordered))
+        }
+        return list
+    case json.Number:
+        if n, err := v.Int64(); err == nil {
+            return n
+        }
+        f, _ := v.Float64()
+        return f
+    case int:
+        return int64(v)
+    }
+    return v
+}
+
+//Validate reports keys of a config file that are unknown, without applying defaults
+//or reading includes
+func Validate(content []byte, format string) error {
+    cfg := &Config{}
+    return decode(content, format, cfg)
+}
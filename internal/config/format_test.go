@@ -0,0 +1,64 @@
+package config
+
+import (
+    "io/ioutil"
+    "reflect"
+    "testing"
+)
+
+//decodeFile reads a config in a format the way LoadConfigFile does, without the defaults
+func decodeFile(t *testing.T, content []byte, format string) *Config {
+    cfg := &Config{}
+    if err := decode(content, format, cfg); err != nil {
+        t.Fatalf("decoding %s: %v\n%s", format, err, content)
+    }
+    return cfg
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+    content, err := ioutil.ReadFile("../../config/default.yml")
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := decodeFile(t, content, "yaml")
+
+    for _, format := range []string{"toml", "json", "yaml"} {
+        tree, err := Decode(content, "yaml")
+        if err != nil {
+            t.Fatal(err)
+        }
+        converted, err := Encode(tree, format)
+        if err != nil {
+            t.Fatalf("encoding %s: %v", format, err)
+        }
+        if got := decodeFile(t, converted, format); !reflect.DeepEqual(got, want) {
+            t.Errorf("%s: converted config differs\n%s", format, converted)
+        }
+
+        //and back again
+        tree, err = Decode(converted, format)
+        if err != nil {
+            t.Fatalf("decoding %s: %v", format, err)
+        }
+        back, err := Encode(tree, "yaml")
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := decodeFile(t, back, "yaml"); !reflect.DeepEqual(got, want) {
+            t.Errorf("%s: config converted back to yaml differs\n%s", format, back)
+        }
+    }
+}
+
+func TestUnknownKeys(t *testing.T) {
+    files := map[string]string{
+        "yaml": "monit:\n  listen: \":4000\"\n  lisen: \":4001\"\n",
+        "toml": "[monit]\nlisten = \":4000\"\nlisen = \":4001\"\n",
+        "json": `{"monit": {"listen": ":4000", "lisen": ":4001"}}`,
+    }
+    for format, content := range files {
+        if err := Validate([]byte(content), format); err == nil {
+            t.Errorf("%s: unknown key accepted", format)
+        }
+    }
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+var (
+    //envRegexp matches ${VAR} and ${VAR:-default}, $${ escapes a literal ${
+    envRegexp = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+)
+
+//expandEnv replaces ${VAR} with the value of the environment variable and ${VAR:-default} with
+//the default when it is unset or empty; ${VAR} of an unset variable is left alone
+func expandEnv(value string) string {
+    return envRegexp.ReplaceAllStringFunc(value, func(match string) string {
+        if strings.HasPrefix(match, "$$") {
+            return match[1:]
+        }
+        m := envRegexp.FindStringSubmatch(match)
+        env, ok := os.LookupEnv(m[1])
+        if m[2] != "" {
+            if env == "" {
+                return m[3]
+            }
+            return env
+        }
+        if !ok {
+            return match
+        }
+        return env
+    })
+}
+
+//expand expands the environment variables in the string settings of a decoded config, except in
+//the fields tagged env:"-" like the replacements of regexp rewrites, where ${name} is a group
+func expand(cfg interface{}) {
+    expandFields(reflect.ValueOf(cfg))
+}
+
+//expandFields walks the structs, slices, maps and pointers below v, so a value of a variable
+//can not change the structure of the file it is read from
+func expandFields(v reflect.Value) {
+    switch v.Kind() {
+    case reflect.Ptr, reflect.Interface:
+        if !v.IsNil() {
+            expandFields(v.Elem())
+        }
+    case reflect.Struct:
+        for i := 0; i < v.NumField(); i++ {
+            if field := v.Type().Field(i); field.PkgPath == "" && field.Tag.Get("env") != "-" {
+                expandFields(v.Field(i))
+            }
+        }
+    case reflect.Slice, reflect.Array:
+        for i := 0; i < v.Len(); i++ {
+            expandFields(v.Index(i))
+        }
+    case reflect.Map:
+        for _, key := range v.MapKeys() {
+            value := v.MapIndex(key)
+            if value.Kind() == reflect.String {
+                v.SetMapIndex(key, reflect.ValueOf(expandEnv(value.String())).Convert(value.Type()))
+                continue
+            }
+            copied := reflect.New(value.Type()).Elem()
+            copied.Set(value)
+            expandFields(copied)
+            v.SetMapIndex(key, copied)
+        }
+    case reflect.String:
+        if v.CanSet() {
+            v.SetString(expandEnv(v.String()))
+        }
+    }
+}
+
+//include adds the streams of the files listed under include to the config; an entry is a file,
+//a glob pattern or a directory whose *.yml, *.yaml, *.toml and *.json files are read in name order,
+//relative to the directory of the including file
+func include(cfg *Config, dir string) error {
+    for _, pattern := range cfg.Include {
+        if !filepath.IsAbs(pattern) {
+            pattern = filepath.Join(dir, pattern)
+        }
+
+        files, err := includeFiles(pattern)
+        if err != nil {
+            return fmt.Errorf("include %q: %v", pattern, err)
+        }
+
+        for _, file := range files {
+            content, err := ioutil.ReadFile(file)
+            if err != nil {
+                return err
+            }
+            part := &struct {
+                Streams []Stream
+            }{}
+            if err := decode(content, FormatOf(file), part); err != nil {
+                return fmt.Errorf("%s: %v", file, err)
+            }
+            expand(part)
+            resolveLookups(part.Streams, filepath.Dir(file))
+            cfg.Write.Streams = append(cfg.Write.Streams, part.Streams...)
+        }
+    }
+
+    return nil
+}
+
+//resolveLookups makes the relative lookup files of streams relative to dir, the directory of the
+//file the streams were read from, like the include patterns
+func resolveLookups(streams []Stream, dir string) {
+    for i := range streams {
+        for j := range streams[i].Locations {
+            enrich := streams[i].Locations[j].Enrich
+            if enrich == nil {
+                continue
+            }
+            for k := range enrich.Lookups {
+                if file := enrich.Lookups[k].File; file != "" && !filepath.IsAbs(file) {
+                    enrich.Lookups[k].File = filepath.Join(dir, file)
+                }
+            }
+        }
+    }
+}
+
+func includeFiles(pattern string) ([]string, error) {
+    if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+        var files []string
+        for _, ext := range []string{"*.yml", "*.yaml", "*.toml", "*.json"} {
+            matches, err := filepath.Glob(filepath.Join(pattern, ext))
+            if err != nil {
+                return nil, err
+            }
+            files = append(files, matches...)
+        }
+        sort.Strings(files)
+        return files, nil
+    }
+
+    files, err := filepath.Glob(pattern)
+    if err != nil {
+        return nil, err
+    }
+    if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+        return nil, fmt.Errorf("no such file")
+    }
+
+    return files, nil
+}
+
+//readSecrets replaces the *_file references of a location with the content of the files
+func readSecrets(locat *Location) error {
+    if err := readSecret(&locat.Password, locat.Password_file); err != nil {
+        return fmt.Errorf("location %q: password: %v", locat.ID(), err)
+    }
+    for i := range locat.Redact {
+        if err := readSecret(&locat.Redact[i].Key, locat.Redact[i].Key_file); err != nil {
+            return fmt.Errorf("location %q: redact key: %v", locat.ID(), err)
+        }
+    }
+    return nil
+}
+
+//readSecret sets value to the content of file, without the final line break
+func readSecret(value *string, file string) error {
+    if file == "" {
+        return nil
+    }
+    if *value != "" {
+        return fmt.Errorf("the value and the file of a secret are exclusive")
+    }
+    content, err := ioutil.ReadFile(file)
+    if err != nil {
+        return err
+    }
+    *value = strings.TrimRight(string(content), "\r\n")
+
+    return nil
+}
+
+//Config loads the certificates of the tls section, it returns nil without one
+func (t *Tls) Config() (*tls.Config, error) {
+    if t == nil {
+        return nil, nil
+    }
+
+    conf := &tls.Config{
+        ServerName:         t.Server_name,
+        InsecureSkipVerify: t.Insecure_skip_verify,
+    }
+
+    if t.Ca_file != "" {
+        pem, err := ioutil.ReadFile(t.Ca_file)
+        if err != nil {
+            return nil, err
+        }
+        conf.RootCAs = x509.NewCertPool()
+        if !conf.RootCAs.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("no certificates found in %s", t.Ca_file)
+        }
+    }
+
+    if t.Cert_file != "" || t.Key_file != "" {
+        cert, err := tls.LoadX509KeyPair(t.Cert_file, t.Key_file)
+        if err != nil {
+            return nil, err
+        }
+        conf.Certificates = []tls.Certificate{cert}
+    }
+
+    return conf, nil
+}
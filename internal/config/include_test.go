@@ -0,0 +1,76 @@
+package config
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+    os.Setenv("RELAY_TEST_URL", "http://127.0.0.1:8086/write\"]\n          name: \"injected")
+    defer os.Unsetenv("RELAY_TEST_URL")
+    os.Setenv("host", "from-env")
+    defer os.Unsetenv("host")
+
+    file := writeConfig(t, `
+write:
+  streams:
+    - listen: "${RELAY_TEST_LISTEN:-:7086}"
+      locations:
+        - urls: ["${RELAY_TEST_URL}"]
+          username: "$${literal}"
+          regexp:
+            - match: '(?P<host>x)'
+              replace: '${host}'
+`)
+    defer os.RemoveAll(filepath.Dir(file))
+
+    cfg, err := LoadConfigFile(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    stream := cfg.Write.Streams[0]
+    locat := stream.Locations[0]
+    if stream.Listen != ":7086" {
+        t.Errorf("listen = %q, want the default", stream.Listen)
+    }
+    //a value can not add settings, it stays one string
+    if len(locat.Urls) != 1 || !strings.Contains(locat.Urls[0], "injected") || locat.Name != "" {
+        t.Errorf("urls = %q, name = %q", locat.Urls, locat.Name)
+    }
+    if locat.Username != "${literal}" {
+        t.Errorf("username = %q, want the escaped placeholder", locat.Username)
+    }
+    if locat.Regexp[0].Replace != "${host}" {
+        t.Errorf("replace = %q, replacements are not expanded", locat.Regexp[0].Replace)
+    }
+}
+
+func TestLookupRelative(t *testing.T) {
+    file := writeConfig(t, `
+write:
+  streams:
+    - listen: ":7086"
+      locations:
+        - urls: ["http://127.0.0.1:8086/write"]
+          enrich:
+            lookups:
+              - file: "hosts.csv"
+                keys: ["host"]
+`)
+    dir := filepath.Dir(file)
+    defer os.RemoveAll(dir)
+    if err := ioutil.WriteFile(filepath.Join(dir, "hosts.csv"), []byte("host,dc\na,one\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    cfg, err := LoadConfigFile(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := cfg.Write.Streams[0].Locations[0].Enrich.Lookups[0].File; got != filepath.Join(dir, "hosts.csv") {
+        t.Errorf("lookup file = %q, want it next to the config file", got)
+    }
+}
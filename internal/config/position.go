@@ -0,0 +1,272 @@
+package config
+
+import (
+    "bytes"
+    "encoding/json"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+var (
+    //yamlKeyRegexp matches the key of a block mapping entry, quoted or plain
+    yamlKeyRegexp = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s#'"\-][^:#]*?|-[^\s:#][^:#]*?)\s*:(\s+|$)`)
+    //tomlKeyRegexp matches the dotted key of a toml key/value pair
+    tomlKeyRegexp = regexp.MustCompile(`^((?:"[^"]*"|'[^']*'|[A-Za-z0-9_-]+)(?:\s*\.\s*(?:"[^"]*"|'[^']*'|[A-Za-z0-9_-]+))*)\s*=`)
+    //tomlTableRegexp matches a table or array of tables header
+    tomlTableRegexp = regexp.MustCompile(`^(\[\[?)\s*([^\]]+?)\s*\]\]?\s*(#.*)?$`)
+)
+
+//positions maps the paths of the values of a config file, keys in lower case and sequence
+//indexes joined by dots like write.streams.0.listen, to the lines they start on
+type positions map[string]int
+
+//line returns the line of path, or of the closest enclosing value the file has a position for;
+//it is 0 for values the file does not hold, like the streams of included files
+func (p positions) line(path string) int {
+    for path != "" {
+        if line, ok := p[path]; ok {
+            return line
+        }
+        i := strings.LastIndexByte(path, '.')
+        if i < 0 {
+            break
+        }
+        path = path[:i]
+    }
+    return 0
+}
+
+//has reports whether the file holds the value at path itself
+func (p positions) has(path string) bool {
+    _, ok := p[path]
+    return ok
+}
+
+//locate reads the positions of the values of a config file in a format, a file that does not parse
+//has none
+func locate(content []byte, format string) positions {
+    pos := make(positions)
+    switch format {
+    case "yaml", "yml":
+        locateYAML(content, pos)
+    case "toml":
+        locateTOML(content, pos)
+    case "json":
+        locateJSON(content, pos)
+    }
+    return pos
+}
+
+func join(path string, key string) string {
+    key = strings.ToLower(strings.Trim(strings.TrimSpace(key), `"'`))
+    if path == "" {
+        return key
+    }
+    return path + "." + key
+}
+
+//yamlLevel is an open block mapping or sequence, last is the path of its latest key or item
+type yamlLevel struct {
+    indent       int
+    seq          bool
+    path         string
+    last         string
+    items        int
+}
+
+//locateYAML follows the indentation of block mappings and sequences, flow collections are
+//placed at the line of their key
+func locateYAML(content []byte, pos positions) {
+    var stack []*yamlLevel
+    scalar := -1
+
+    for n, raw := range strings.Split(string(content), "\n") {
+        text := strings.TrimLeft(raw, " ")
+        col := len(raw) - len(text)
+        text = strings.TrimRight(text, " \t\r")
+        if text == "" || strings.HasPrefix(text, "#") || text == "---" {
+            continue
+        }
+        //the lines of a block scalar belong to its key
+        if scalar >= 0 {
+            if col > scalar {
+                continue
+            }
+            scalar = -1
+        }
+
+        for text != "" {
+            if text == "-" || strings.HasPrefix(text, "- ") {
+                for len(stack) > 0 && stack[len(stack)-1].indent > col {
+                    stack = stack[:len(stack)-1]
+                }
+                top := (*yamlLevel)(nil)
+                if len(stack) > 0 {
+                    top = stack[len(stack)-1]
+                }
+                if top == nil || !top.seq || top.indent != col {
+                    parent := ""
+                    if top != nil {
+                        parent = top.last
+                    }
+                    top = &yamlLevel{indent: col, seq: true, path: parent}
+                    stack = append(stack, top)
+                } else {
+                    top.items++
+                }
+                top.last = top.path + "." + strconv.Itoa(top.items)
+                pos[strings.TrimPrefix(top.last, ".")] = n + 1
+
+                rest := strings.TrimLeft(text[1:], " ")
+                col += len(text) - len(rest)
+                text = rest
+                continue
+            }
+
+            m := yamlKeyRegexp.FindStringSubmatch(text)
+            if m == nil {
+                break
+            }
+            for len(stack) > 0 {
+                top := stack[len(stack)-1]
+                if top.indent > col || (top.indent == col && top.seq) {
+                    stack = stack[:len(stack)-1]
+                    continue
+                }
+                break
+            }
+            var top *yamlLevel
+            if len(stack) > 0 {
+                top = stack[len(stack)-1]
+            }
+            if top == nil || top.seq || top.indent != col {
+                parent := ""
+                if top != nil {
+                    parent = strings.TrimPrefix(top.last, ".")
+                }
+                top = &yamlLevel{indent: col, path: parent}
+                stack = append(stack, top)
+            }
+            top.last = join(top.path, m[1])
+            pos[top.last] = n + 1
+
+            value := strings.TrimSpace(text[len(m[0]):])
+            if strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+                scalar = col
+            }
+            break
+        }
+    }
+}
+
+//locateTOML follows the table headers and key/value pairs, multi-line values are placed at the
+//line of their key
+func locateTOML(content []byte, pos positions) {
+    table := ""
+    arrays := make(map[string]int)
+
+    for n, raw := range strings.Split(string(content), "\n") {
+        text := strings.TrimSpace(raw)
+        if text == "" || strings.HasPrefix(text, "#") {
+            continue
+        }
+
+        if m := tomlTableRegexp.FindStringSubmatch(text); m != nil {
+            //the tables of an array of tables nest below its latest element
+            table = ""
+            keys := splitKey(m[2])
+            for i, key := range keys {
+                table = join(table, key)
+                if cnt, ok := arrays[table]; ok && (m[1] != "[[" || i < len(keys)-1) {
+                    table += "." + strconv.Itoa(cnt-1)
+                }
+            }
+            if m[1] == "[[" {
+                arrays[table]++
+                table += "." + strconv.Itoa(arrays[table]-1)
+            }
+            pos[table] = n + 1
+            continue
+        }
+
+        if m := tomlKeyRegexp.FindStringSubmatch(text); m != nil {
+            path := table
+            for _, key := range splitKey(m[1]) {
+                path = join(path, key)
+            }
+            pos[path] = n + 1
+        }
+    }
+}
+
+//splitKey splits a dotted toml key, dots inside quotes are part of the key
+func splitKey(key string) []string {
+    var keys []string
+    quote := byte(0)
+    start := 0
+    for i := 0; i < len(key); i++ {
+        switch c := key[i]; {
+        case quote != 0:
+            if c == quote {
+                quote = 0
+            }
+        case c == '"' || c == '\'':
+            quote = c
+        case c == '.':
+            keys = append(keys, key[start:i])
+            start = i + 1
+        }
+    }
+    return append(keys, key[start:])
+}
+
+//locateJSON reads the tokens of the document, every value is placed at the line its first token ends on
+func locateJSON(content []byte, pos positions) {
+    var starts []int
+    for i, c := range content {
+        if c == '\n' {
+            starts = append(starts, i)
+        }
+    }
+    line := func(offset int64) int {
+        return sort.Search(len(starts), func(i int) bool { return int64(starts[i]) >= offset }) + 1
+    }
+
+    dec := json.NewDecoder(bytes.NewReader(content))
+    var value func(path string) bool
+    value = func(path string) bool {
+        tok, err := dec.Token()
+        if err != nil {
+            return false
+        }
+        if path != "" {
+            pos[path] = line(dec.InputOffset())
+        }
+        switch tok {
+        case json.Delim('{'):
+            for dec.More() {
+                key, err := dec.Token()
+                if err != nil {
+                    return false
+                }
+                if !value(join(path, key.(string))) {
+                    return false
+                }
+            }
+            _, err = dec.Token()
+            return err == nil
+        case json.Delim('['):
+            for i := 0; dec.More(); i++ {
+                if !value(path + "." + strconv.Itoa(i)) {
+                    return false
+                }
+            }
+            _, err = dec.Token()
+            return err == nil
+        }
+        return true
+    }
+    value("")
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+    "testing"
+)
+
+func TestLocate(t *testing.T) {
+    files := map[string]string{
+        "yaml": `write:
+  streams:
+    - listen: ":7086"
+      locations:
+      - urls: ["http://a:8086/write"]
+      - urls:
+          - "http://b:8086/write"
+          - "http://c:8086/write"
+        regexp:
+          - match: "cpu"
+            replace: "${x}"
+    - listen: ":7087"
+`,
+        "toml": `[write]
+
+[[write.streams]]
+listen = ":7086"
+
+[[write.streams.locations]]
+urls = ["http://a:8086/write"]
+
+[[write.streams.locations]]
+urls = [
+  "http://b:8086/write",
+  "http://c:8086/write",
+]
+[[write.streams.locations.regexp]]
+match = "cpu"
+replace = "${x}"
+
+[[write.streams]]
+listen = ":7087"
+`,
+        "json": `{
+  "write": {
+    "streams": [
+      {
+        "listen": ":7086",
+        "locations": [
+          {"urls": ["http://a:8086/write"]},
+          {"urls": [
+            "http://b:8086/write",
+            "http://c:8086/write"],
+           "regexp": [
+             {"match": "cpu",
+              "replace": "${x}"}]}
+        ]
+      },
+      {"listen": ":7087"}
+    ]
+  }
+}
+`,
+    }
+    want := map[string]map[string]int{
+        "yaml": {
+            "write.streams.0.listen": 3,
+            "write.streams.0.locations.1.urls.1": 8,
+            "write.streams.0.locations.1.regexp.0.replace": 11,
+            "write.streams.1.listen": 12,
+            "write.streams.0.locations.0.urls.0": 5,
+        },
+        "toml": {
+            "write.streams.0.listen": 4,
+            "write.streams.0.locations.1.urls.1": 10,
+            "write.streams.0.locations.1.regexp.0.replace": 16,
+            "write.streams.1.listen": 19,
+            "write.streams.0.locations.0.urls.0": 7,
+        },
+        "json": {
+            "write.streams.0.listen": 5,
+            "write.streams.0.locations.1.urls.1": 10,
+            "write.streams.0.locations.1.regexp.0.replace": 13,
+            "write.streams.1.listen": 16,
+            "write.streams.0.locations.0.urls.0": 7,
+        },
+    }
+
+    for format, content := range files {
+        pos := locate([]byte(content), format)
+        for path, line := range want[format] {
+            if got := pos.line(path); got != line {
+                t.Errorf("%s: line of %s = %d, want %d", format, path, got, line)
+            }
+        }
+        if pos.has("write.streams.2") {
+            t.Errorf("%s: a third stream was found", format)
+        }
+    }
+}
@@ -0,0 +1,280 @@
+package logger
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "gopkg.in/natefinch/lumberjack.v2"
+)
+
+//Level is the severity of an entry
+type Level int
+
+const (
+    Debug Level = iota
+    Info
+    Warn
+    Error
+)
+
+var levels = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+    if l < Debug || l > Error {
+        return "info"
+    }
+    return levels[l]
+}
+
+//ParseLevel returns the level with the given name
+func ParseLevel(name string) (Level, error) {
+    for i, level := range levels {
+        if strings.EqualFold(name, level) {
+            return Level(i), nil
+        }
+    }
+    return Info, fmt.Errorf("unknown log level %q, use debug, info, warn or error", name)
+}
+
+//Fields are the key-value pairs added to an entry
+type Fields map[string]interface{}
+
+//Logger writes entries of at least its level in one of the formats: text, the classic
+//"date [level] message key=value" lines, logfmt or json
+type Logger struct {
+    mu           sync.Mutex
+    out          io.Writer
+    format       string
+    level        Level
+}
+
+var (
+    std          = &Logger{out: os.Stderr, format: "text", level: Info}
+
+    //Rotation holds the rotation settings of the log files opened with File
+    Rotation     = lumberjack.Logger{MaxSize: 1, MaxBackups: 3, MaxAge: 10, Compress: true}
+
+    filesMu      sync.Mutex
+    files        = make(map[string]io.Writer)
+)
+
+//New returns a logger writing to out in the format of the default logger
+func New(out io.Writer) *Logger {
+    std.mu.Lock()
+    defer std.mu.Unlock()
+    return &Logger{out: out, format: std.format, level: Debug}
+}
+
+//Default returns the server logger
+func Default() *Logger {
+    return std
+}
+
+//Setup sets the format and the level of the server logger
+func Setup(format string, level string) error {
+    switch format {
+    case "":
+        format = "text"
+    case "text", "logfmt", "json":
+    default:
+        return fmt.Errorf("unknown log format %q, use text, logfmt or json", format)
+    }
+    lvl, err := ParseLevel(level)
+    if err != nil {
+        return err
+    }
+
+    std.mu.Lock()
+    defer std.mu.Unlock()
+    std.format, std.level = format, lvl
+    return nil
+}
+
+//SetOutput sets the destination of the server logger
+func SetOutput(out io.Writer) {
+    std.mu.Lock()
+    defer std.mu.Unlock()
+    std.out = out
+}
+
+//File returns the rotated log file with the given name, the same writer for every call
+func File(name string) io.Writer {
+    filesMu.Lock()
+    defer filesMu.Unlock()
+
+    if file, ok := files[name]; ok {
+        return file
+    }
+    file := &lumberjack.Logger{
+        Filename:   name,
+        MaxSize:    Rotation.MaxSize,
+        MaxBackups: Rotation.MaxBackups,
+        MaxAge:     Rotation.MaxAge,
+        Compress:   Rotation.Compress,
+    }
+    files[name] = file
+    return file
+}
+
+//Enabled reports whether entries of the level are written
+func (l *Logger) Enabled(level Level) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return level >= l.level
+}
+
+//Log writes an entry
+func (l *Logger) Log(level Level, msg string, fields Fields) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if level < l.level {
+        return
+    }
+
+    keys := make([]string, 0, len(fields))
+    for key := range fields {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    now := time.Now()
+    buf := &bytes.Buffer{}
+
+    switch l.format {
+    case "json":
+        buf.WriteString(`{"ts":`)
+        buf.Write(quoteJSON(now.UTC().Format(time.RFC3339Nano)))
+        buf.WriteString(`,"level":`)
+        buf.Write(quoteJSON(level.String()))
+        buf.WriteString(`,"msg":`)
+        buf.Write(quoteJSON(msg))
+        for _, key := range keys {
+            buf.WriteByte(',')
+            buf.Write(quoteJSON(key))
+            buf.WriteByte(':')
+            value, err := json.Marshal(fields[key])
+            if err != nil {
+                value = quoteJSON(fmt.Sprint(fields[key]))
+            }
+            buf.Write(value)
+        }
+        buf.WriteString("}\n")
+    case "logfmt":
+        fmt.Fprintf(buf, "ts=%s level=%s msg=%s", now.UTC().Format(time.RFC3339Nano), level, quoteLogfmt(msg))
+        for _, key := range keys {
+            fmt.Fprintf(buf, " %s=%s", key, quoteLogfmt(fmt.Sprint(fields[key])))
+        }
+        buf.WriteByte('\n')
+    default:
+        fmt.Fprintf(buf, "%s [%s] %s", now.Format("2006/01/02 15:04:05"), level, msg)
+        for _, key := range keys {
+            fmt.Fprintf(buf, " %s=%s", key, quoteLogfmt(fmt.Sprint(fields[key])))
+        }
+        buf.WriteByte('\n')
+    }
+
+    l.out.Write(buf.Bytes())
+}
+
+func quoteJSON(s string) []byte {
+    out, _ := json.Marshal(s)
+    return out
+}
+
+//quoteLogfmt quotes values holding spaces, quotes or equal signs
+func quoteLogfmt(s string) string {
+    if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+        return strconv.Quote(s)
+    }
+    return s
+}
+
+//Entry is a set of fields shared by several log calls
+type Entry struct {
+    logger       *Logger
+    fields       Fields
+}
+
+//With returns an entry of the server logger with the fields
+func With(fields Fields) *Entry {
+    return std.With(fields)
+}
+
+//With returns an entry of the logger with the fields
+func (l *Logger) With(fields Fields) *Entry {
+    return &Entry{logger: l, fields: fields}
+}
+
+//With returns an entry with the fields added to the ones of e
+func (e *Entry) With(fields Fields) *Entry {
+    all := make(Fields, len(e.fields)+len(fields))
+    for key, value := range e.fields {
+        all[key] = value
+    }
+    for key, value := range fields {
+        all[key] = value
+    }
+    return &Entry{logger: e.logger, fields: all}
+}
+
+func (e *Entry) Debugf(format string, args ...interface{}) {
+    e.logger.Log(Debug, fmt.Sprintf(format, args...), e.fields)
+}
+
+func (e *Entry) Infof(format string, args ...interface{}) {
+    e.logger.Log(Info, fmt.Sprintf(format, args...), e.fields)
+}
+
+func (e *Entry) Warnf(format string, args ...interface{}) {
+    e.logger.Log(Warn, fmt.Sprintf(format, args...), e.fields)
+}
+
+func (e *Entry) Errorf(format string, args ...interface{}) {
+    e.logger.Log(Error, fmt.Sprintf(format, args...), e.fields)
+}
+
+func Debugf(format string, args ...interface{}) {
+    std.Log(Debug, fmt.Sprintf(format, args...), nil)
+}
+
+func Infof(format string, args ...interface{}) {
+    std.Log(Info, fmt.Sprintf(format, args...), nil)
+}
+
+func Warnf(format string, args ...interface{}) {
+    std.Log(Warn, fmt.Sprintf(format, args...), nil)
+}
+
+func Errorf(format string, args ...interface{}) {
+    std.Log(Error, fmt.Sprintf(format, args...), nil)
+}
+
+//Writer returns a writer for the standard log package, its "[level] message" lines
+//become entries of the server logger; call log.SetFlags(0) so they carry no date
+func Writer() io.Writer {
+    return writer{}
+}
+
+type writer struct{}
+
+func (writer) Write(p []byte) (int, error) {
+    msg := strings.TrimRight(string(p), "\n")
+    level := Info
+    if strings.HasPrefix(msg, "[") {
+        if i := strings.Index(msg, "] "); i > 0 {
+            if lvl, err := ParseLevel(msg[1:i]); err == nil {
+                level, msg = lvl, msg[i+2:]
+            }
+        }
+    }
+    std.Log(level, msg, nil)
+    return len(p), nil
+}
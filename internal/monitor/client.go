@@ -0,0 +1,50 @@
+package monitor
+
+import (
+    "net"
+    "sync"
+)
+
+var (
+    //clientMu guards the settings below, a reload changes them while requests are counted
+    clientMu     sync.RWMutex
+    clientMode   = "cidr"
+    clientMask4  = net.CIDRMask(24, 32)
+    clientMask6  = net.CIDRMask(64, 128)
+)
+
+//SetClient sets how clients are labelled: "ip" by address, "cidr" by the network of the
+//address with the given prefix lengths, "off" not at all; addresses that do not parse are
+//labelled "invalid" with "cidr"
+func SetClient(mode string, v4 int, v6 int) {
+    clientMu.Lock()
+    defer clientMu.Unlock()
+
+    clientMode = mode
+    clientMask4 = net.CIDRMask(v4, 32)
+    clientMask6 = net.CIDRMask(v6, 128)
+}
+
+//Client returns the label value of a client address
+func Client(addr string) string {
+    clientMu.RLock()
+    defer clientMu.RUnlock()
+
+    switch clientMode {
+    case "off":
+        return ""
+    case "cidr":
+        ip := net.ParseIP(addr)
+        if ip == nil {
+            //arbitrary values would give every one a series of its own
+            return "invalid"
+        }
+        if ip4 := ip.To4(); ip4 != nil {
+            n := &net.IPNet{IP: ip4.Mask(clientMask4), Mask: clientMask4}
+            return n.String()
+        }
+        n := &net.IPNet{IP: ip.Mask(clientMask6), Mask: clientMask6}
+        return n.String()
+    }
+    return addr
+}
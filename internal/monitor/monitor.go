@@ -12,7 +12,7 @@ var (
         prometheus.CounterOpts{
             Namespace: "relay_server",
             Name:      "req_count",
-            Help:      "",
+            Help:      "Write requests received per listen address.",
         },
         []string{"listen"},
     )
@@ -21,16 +21,16 @@ var (
         prometheus.CounterOpts{
             Namespace: "relay_server",
             Name:      "pnt_counter",
-            Help:      "",
+            Help:      "Points received per client and stream.",
         },
-        []string{"rhost","uri"},
+        []string{"rhost","listen"},
     )
 
     DrpCounter = prometheus.NewCounterVec(
         prometheus.CounterOpts{
             Namespace: "relay_server",
             Name:      "req_dropped",
-            Help:      "",
+            Help:      "Batches neither delivered nor cached, per last backend url tried.",
         },
         []string{"url"},
     )
@@ -39,9 +39,189 @@ var (
         prometheus.CounterOpts{
             Namespace: "relay_server",
             Name:      "err_count",
-            Help:      "",
+            Help:      "Lines failing to parse per client and stream.",
+        },
+        []string{"rhost","listen"},
+    )
+
+    RequestDuration = prometheus.NewHistogramVec(
+        prometheus.HistogramOpts{
+            Namespace: "relay_server",
+            Name:      "backend_request_duration_seconds",
+            Help:      "Duration of the requests to a backend url.",
+            Buckets:   prometheus.DefBuckets,
+        },
+        []string{"url"},
+    )
+
+    RequestBytes = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "relay_server",
+            Name:      "backend_request_bytes",
+            Help:      "Bytes sent to a backend url.",
+        },
+        []string{"url"},
+    )
+
+    ResponseBytes = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "relay_server",
+            Name:      "backend_response_bytes",
+            Help:      "Bytes received from a backend url.",
+        },
+        []string{"url"},
+    )
+
+    Responses = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "relay_server",
+            Name:      "backend_responses",
+            Help:      "Responses of a backend url per status code, 503 includes connection errors.",
+        },
+        []string{"url","code"},
+    )
+
+    InFlight = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "relay_server",
+            Name:      "backend_requests_in_flight",
+            Help:      "Requests to a backend url waiting for their response.",
+        },
+        []string{"url"},
+    )
+
+    Points = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "relay_server",
+            Name:      "location_points",
+            Help:      "Points per location by result: delivered, cached, replayed, rejected, dropped or aggregated.",
+        },
+        []string{"location","result"},
+    )
+
+    CacheEvicted = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "relay_server",
+            Name:      "cache_evicted",
+            Help:      "Cache entries evicted by the cache limits.",
+        },
+        []string{"location","reason"},
+    )
+
+    DeadLetters = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "relay_server",
+            Name:      "dead_letter_entries",
+            Help:      "Batches currently held in the dead-letter store.",
+        },
+        []string{"reason"},
+    )
+
+    DeadLettered = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "relay_server",
+            Name:      "dead_letter_count",
+            Help:      "Batches moved to the dead-letter store.",
+        },
+        []string{"reason"},
+    )
+
+    BreakerState = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "relay_server",
+            Name:      "breaker_state",
+            Help:      "Circuit breaker state per backend url: 0 closed, 1 half-open, 2 open.",
+        },
+        []string{"url"},
+    )
+
+    BreakerTransitions = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "relay_server",
+            Name:      "breaker_transitions",
+            Help:      "Circuit breaker transitions per backend url and new state.",
+        },
+        []string{"url","state"},
+    )
+
+    BackendUp = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "relay_server",
+            Name:      "backend_up",
+            Help:      "Whether the health check of a backend url passes.",
+        },
+        []string{"url"},
+    )
+
+    IngestDelay = prometheus.NewHistogramVec(
+        prometheus.HistogramOpts{
+            Namespace: "relay_server",
+            Name:      "ingest_delay_seconds",
+            Help:      "Time between the timestamp of a point and its receipt, per stream and allow-listed measurement.",
+            Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600, 21600, 86400},
+        },
+        []string{"listen","measurement"},
+    )
+
+    FuturePoints = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "relay_server",
+            Name:      "future_points",
+            Help:      "Points dated further ahead of their receipt than the freshness future setting, per stream.",
+        },
+        []string{"listen"},
+    )
+
+    LatePoints = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "relay_server",
+            Name:      "late_points",
+            Help:      "Points dated further back than the freshness late setting, per stream.",
+        },
+        []string{"listen"},
+    )
+
+    GuardedPoints = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "relay_server",
+            Name:      "timestamp_guard_points",
+            Help:      "Points out of the window of a timestamp guard per stream, location (empty for a stream guard), reason and action.",
+        },
+        []string{"listen","location","reason","action"},
+    )
+
+    AggregatedPoints = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "relay_server",
+            Name:      "aggregate_points",
+            Help:      "Points taken into the windows of an aggregating location, or dropped as late.",
+        },
+        []string{"location","result"},
+    )
+
+    ConfigReloads = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "relay_server",
+            Name:      "config_reloads",
+            Help:      "Configuration reloads by result.",
+        },
+        []string{"result"},
+    )
+
+    ConfigReloadSuccess = prometheus.NewGauge(
+        prometheus.GaugeOpts{
+            Namespace: "relay_server",
+            Name:      "config_last_reload_successful",
+            Help:      "Whether the last configuration reload succeeded.",
+        },
+    )
+
+    ConfigReloadTime = prometheus.NewGauge(
+        prometheus.GaugeOpts{
+            Namespace: "relay_server",
+            Name:      "config_last_reload_success_timestamp_seconds",
+            Help:      "Unix time of the last successful configuration reload.",
         },
-        []string{"rhost","uri"},
     )
 )
 
@@ -53,6 +233,26 @@ func Start(listen string){
     prometheus.MustRegister(PntCounter)
     prometheus.MustRegister(DrpCounter)
     prometheus.MustRegister(ErrCounter)
+    prometheus.MustRegister(CacheEvicted)
+    prometheus.MustRegister(DeadLetters)
+    prometheus.MustRegister(DeadLettered)
+    prometheus.MustRegister(BreakerState)
+    prometheus.MustRegister(BreakerTransitions)
+    prometheus.MustRegister(BackendUp)
+    prometheus.MustRegister(RequestDuration)
+    prometheus.MustRegister(RequestBytes)
+    prometheus.MustRegister(ResponseBytes)
+    prometheus.MustRegister(Responses)
+    prometheus.MustRegister(InFlight)
+    prometheus.MustRegister(Points)
+    prometheus.MustRegister(IngestDelay)
+    prometheus.MustRegister(FuturePoints)
+    prometheus.MustRegister(LatePoints)
+    prometheus.MustRegister(GuardedPoints)
+    prometheus.MustRegister(AggregatedPoints)
+    prometheus.MustRegister(ConfigReloads)
+    prometheus.MustRegister(ConfigReloadSuccess)
+    prometheus.MustRegister(ConfigReloadTime)
 
     go http.ListenAndServe(listen, nil)
 }
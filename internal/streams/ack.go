@@ -0,0 +1,106 @@
+package streams
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+)
+
+//SendError describes the last failed attempt to deliver a batch to a location;
+//Rejected is set when a backend refused the batch with a status that is not retried
+type SendError struct {
+    Url          string
+    Code         int
+    Body         string
+    Cached       bool
+    Rejected     bool
+}
+
+func (e *SendError) Error() string {
+    if e.Url == "" {
+        return "no backend urls"
+    }
+    if e.Body == "" {
+        return fmt.Sprintf("%s: %d", e.Url, e.Code)
+    }
+    return fmt.Sprintf("%s: %d %s", e.Url, e.Code, e.Body)
+}
+
+//ConsistencyAck maps the InfluxDB consistency query parameter to an ack policy, an unknown level
+//is an error rather than a weaker ack
+func ConsistencyAck(consistency string) (string, error) {
+    switch consistency {
+    case "any", "one":
+        return "any", nil
+    case "quorum", "all":
+        return consistency, nil
+    }
+    return "", fmt.Errorf("invalid consistency level %q, use any, one, quorum or all", consistency)
+}
+
+//ackRequired returns how many of total locations must succeed under the ack policy
+func ackRequired(ack string, total int) int {
+    switch ack {
+    case "any":
+        return 1
+    case "quorum":
+        return total/2 + 1
+    case "all", "durable":
+        return total
+    }
+    return 0
+}
+
+//waitAck collects location results until the ack policy is met, cannot be met any more or the deadline passes
+func waitAck(ack string, total int, results <-chan error, timeout time.Duration) (int, error) {
+    required := ackRequired(ack, total)
+    if required == 0 || total == 0 {
+        return 0, nil
+    }
+
+    var deadline <-chan time.Time
+    if timeout > 0 {
+        timer := time.NewTimer(timeout * time.Second)
+        defer timer.Stop()
+        deadline = timer.C
+    }
+
+    succeeded := 0
+    var failed []*SendError
+
+    for succeeded + len(failed) < total {
+        select {
+        case err := <-results:
+            serr, ok := err.(*SendError)
+            if err != nil && !ok {
+                serr = &SendError{Code: http.StatusServiceUnavailable, Body: err.Error()}
+            }
+            if err == nil || (serr.Cached && ack == "durable") {
+                succeeded++
+            } else {
+                failed = append(failed, serr)
+            }
+        case <-deadline:
+            return http.StatusServiceUnavailable, fmt.Errorf("timeout: ack %s not reached (%d/%d)", ack, succeeded, required)
+        }
+        if succeeded >= required {
+            return 0, nil
+        }
+        if total - len(failed) < required {
+            break
+        }
+    }
+
+    //a client error from any backend is passed on, everything else is reported as unavailable
+    code := http.StatusServiceUnavailable
+    msgs := make([]string, len(failed))
+    for i, serr := range failed {
+        if serr.Code >= 400 && serr.Code < 500 {
+            code = serr.Code
+        }
+        msgs[i] = serr.Error()
+    }
+
+    return code, fmt.Errorf("ack %s not reached (%d/%d): %s", ack, succeeded, required, strings.Join(msgs, "; "))
+}
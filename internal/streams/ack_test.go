@@ -0,0 +1,58 @@
+package streams
+
+import (
+    "net/http"
+    "testing"
+)
+
+func TestConsistencyAck(t *testing.T) {
+    for consistency, want := range map[string]string{"any": "any", "one": "any", "quorum": "quorum", "all": "all"} {
+        if got, err := ConsistencyAck(consistency); err != nil || got != want {
+            t.Errorf("ConsistencyAck(%q) = %q, %v, want %q", consistency, got, err, want)
+        }
+    }
+    if _, err := ConsistencyAck("durable"); err == nil {
+        t.Errorf("ConsistencyAck(durable) accepted an unknown level")
+    }
+}
+
+//results returns a channel holding the results of the locations of a write
+func results(errs ...error) chan error {
+    ch := make(chan error, len(errs))
+    for _, err := range errs {
+        ch <- err
+    }
+    return ch
+}
+
+func TestWaitAck(t *testing.T) {
+    failed := &SendError{Url: "http://127.0.0.1:8086/write", Code: http.StatusServiceUnavailable}
+    cached := &SendError{Url: "http://127.0.0.1:8086/write", Code: http.StatusServiceUnavailable, Cached: true}
+    rejected := &SendError{Url: "http://127.0.0.1:8086/write", Code: http.StatusBadRequest, Rejected: true}
+
+    tests := []struct {
+        ack          string
+        errs         []error
+        code         int
+    }{
+        {"async", []error{failed}, 0},
+        {"any", []error{failed, nil}, 0},
+        {"any", []error{failed, failed}, http.StatusServiceUnavailable},
+        {"quorum", []error{nil, nil, failed}, 0},
+        {"quorum", []error{nil, failed, failed}, http.StatusServiceUnavailable},
+        {"all", []error{nil, cached}, http.StatusServiceUnavailable},
+        {"durable", []error{nil, cached}, 0},
+        {"all", []error{nil, rejected}, http.StatusBadRequest},
+    }
+    for _, test := range tests {
+        code, err := waitAck(test.ack, len(test.errs), results(test.errs...), 1)
+        if code != test.code || (err == nil) != (test.code == 0) {
+            t.Errorf("waitAck(%s, %v) = %d, %v, want %d", test.ack, test.errs, code, err, test.code)
+        }
+    }
+
+    //no location counts for the ack, as with only aggregating ones
+    if code, err := waitAck("all", 0, results(), 1); code != 0 || err != nil {
+        t.Errorf("waitAck(all) without locations = %d, %v", code, err)
+    }
+}
@@ -0,0 +1,365 @@
+package streams
+
+import (
+    "bytes"
+    "math"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/influxdata/line-protocol"
+    "github.com/ltkh/relay-server/internal/config"
+    "github.com/ltkh/relay-server/internal/logger"
+    "github.com/ltkh/relay-server/internal/monitor"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+    //aggregators holds the open windows of every location with an aggregate section
+    aggregatorsMu sync.Mutex
+    aggregators  = make(map[string]*aggregator)
+)
+
+//aggregator keeps the windows of a location, sending them with the settings of the write
+//that added points last
+type aggregator struct {
+    sync.Mutex
+    write        *Write
+    locat        config.Location
+    windows      map[string]*window
+    done         chan struct{}
+}
+
+//window holds the summaries of the fields of one series over one period
+type window struct {
+    query        string
+    auth         string
+    name         string
+    tags         map[string]string
+    start        time.Time
+    due          time.Time
+    fields       map[string]*summary
+}
+
+type summary struct {
+    min          float64
+    max          float64
+    sum          float64
+    count        int64
+    last         float64
+    lastTime     time.Time
+    values       []float64
+}
+
+//aggregate adds the lines of a write to the windows of the location, it returns the lines
+//to send right away: all of them with pass_through, none otherwise
+func aggregate(m *Write, locat config.Location, lines []string, b *batch) []string {
+    a := aggregatorOf(m, locat)
+    a.add(lines, b)
+
+    if locat.Aggregate.Pass_through {
+        return lines
+    }
+    return nil
+}
+
+//aggregatorOf returns the aggregator of a location, starting it on first use
+func aggregatorOf(m *Write, locat config.Location) *aggregator {
+    aggregatorsMu.Lock()
+    defer aggregatorsMu.Unlock()
+
+    a, ok := aggregators[locat.ID()]
+    if !ok {
+        a = &aggregator{windows: make(map[string]*window), done: make(chan struct{})}
+        aggregators[locat.ID()] = a
+        go a.run()
+    }
+
+    a.Lock()
+    a.write, a.locat = m, locat
+    a.Unlock()
+
+    return a
+}
+
+//FlushAggregates sends every open window at once
+func FlushAggregates() {
+    for _, a := range aggregatorList() {
+        a.flush(time.Time{}, false)
+    }
+}
+
+//flushDrained sends every open window while the server drains, once the writes that could still
+//add points to them are done
+func flushDrained() {
+    for _, a := range aggregatorList() {
+        a.flush(time.Time{}, true)
+    }
+}
+
+func aggregatorList() []*aggregator {
+    aggregatorsMu.Lock()
+    defer aggregatorsMu.Unlock()
+
+    list := make([]*aggregator, 0, len(aggregators))
+    for _, a := range aggregators {
+        list = append(list, a)
+    }
+    return list
+}
+
+//PruneAggregates sends the open windows of the locations that no longer aggregate after a reload
+//and forgets them
+func PruneAggregates(conf *config.Config) {
+    aggregatorsMu.Lock()
+    var removed []*aggregator
+    for id, a := range aggregators {
+        if locat, ok := conf.Location(id); ok && locat.Aggregate != nil {
+            continue
+        }
+        delete(aggregators, id)
+        close(a.done)
+        removed = append(removed, a)
+    }
+    aggregatorsMu.Unlock()
+
+    for _, a := range removed {
+        a.flush(time.Time{}, false)
+    }
+}
+
+//run sends the windows that are due every second until the server stops
+func (a *aggregator) run() {
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-stopCtx.Done():
+            return
+        case <-a.done:
+            return
+        case now := <-ticker.C:
+            a.flush(now, false)
+        }
+    }
+}
+
+func (a *aggregator) add(lines []string, b *batch) {
+    handler := protocol.NewMetricHandler()
+    handler.SetTimePrecision(b.unit)
+    parser := protocol.NewParser(handler)
+    parser.SetTimeFunc(func() time.Time { return b.received })
+
+    params, _ := url.ParseQuery(b.query)
+    params.Del("precision")
+    query := params.Encode()
+
+    a.Lock()
+    defer a.Unlock()
+
+    conf := a.locat.Aggregate
+    period := int64(conf.Period * time.Second)
+    now := time.Now()
+    added, late := 0, 0
+
+    for _, line := range lines {
+        if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        metrics, err := parser.Parse([]byte(line))
+        if err != nil || len(metrics) == 0 {
+            continue
+        }
+        metric := metrics[0]
+
+        ts := metric.Time().UnixNano()
+        start := time.Unix(0, ts - ((ts % period) + period) % period)
+        due := start.Add(conf.Period * time.Second + conf.Grace * time.Second)
+        //a window starting after the current one would stay open until its time comes
+        if due.Before(now) || start.After(now.Add(conf.Period * time.Second)) {
+            late++
+            continue
+        }
+
+        tags := make(map[string]string)
+        keys := make([]string, 0)
+        for _, tag := range metric.TagList() {
+            tags[tag.Key] = tag.Value
+            keys = append(keys, tag.Key + "=" + tag.Value)
+        }
+        sort.Strings(keys)
+
+        var w *window
+        for _, field := range metric.FieldList() {
+            var value float64
+            switch v := field.Value.(type) {
+            case float64:
+                value = v
+            case int64:
+                value = float64(v)
+            case uint64:
+                value = float64(v)
+            default:
+                continue
+            }
+            if w == nil {
+                id := query + "\x00" + b.auth + "\x00" + metric.Name() + "\x00" + strings.Join(keys, ",") + "\x00" + strconv.FormatInt(start.UnixNano(), 10)
+                if w = a.windows[id]; w == nil {
+                    w = &window{query: query, auth: b.auth, name: metric.Name(), tags: tags, start: start, due: due, fields: make(map[string]*summary)}
+                    a.windows[id] = w
+                }
+                added++
+            }
+            w.fields[field.Key] = w.fields[field.Key].add(value, metric.Time(), conf.Functions)
+        }
+    }
+
+    if added > 0 {
+        monitor.AggregatedPoints.With(prometheus.Labels{"location":a.locat.ID(),"result":"aggregated"}).Add(float64(added))
+        monitor.Points.With(prometheus.Labels{"location":a.locat.ID(),"result":"aggregated"}).Add(float64(added))
+    }
+    if late > 0 {
+        monitor.AggregatedPoints.With(prometheus.Labels{"location":a.locat.ID(),"result":"late"}).Add(float64(late))
+    }
+}
+
+func (s *summary) add(value float64, t time.Time, functions []string) *summary {
+    if s == nil {
+        s = &summary{min: value, max: value}
+    }
+    s.min = math.Min(s.min, value)
+    s.max = math.Max(s.max, value)
+    s.sum += value
+    s.count++
+    if !t.Before(s.lastTime) {
+        s.last, s.lastTime = value, t
+    }
+    for _, function := range functions {
+        if strings.HasPrefix(function, "p") {
+            s.values = append(s.values, value)
+            break
+        }
+    }
+    return s
+}
+
+//value returns the result of an aggregate function, nil for a percentile of values
+//added before it was configured
+func (s *summary) value(function string) interface{} {
+    switch function {
+    case "min":
+        return s.min
+    case "max":
+        return s.max
+    case "mean":
+        return s.sum / float64(s.count)
+    case "sum":
+        return s.sum
+    case "count":
+        return s.count
+    case "last":
+        return s.last
+    }
+
+    //nearest rank percentile
+    if len(s.values) == 0 {
+        return nil
+    }
+    p, _ := strconv.ParseFloat(function[1:], 64)
+    sort.Float64s(s.values)
+    rank := int(math.Ceil(p / 100 * float64(len(s.values))))
+    if rank < 1 {
+        rank = 1
+    }
+    return s.values[rank-1]
+}
+
+//flush sends the windows due at now, all of them when now is zero; with drain set it runs as part of
+//the drain of the server, which counts it among the sends in flight, otherwise the windows stay open
+//for the drain once the server stops taking new sends
+func (a *aggregator) flush(now time.Time, drain bool) {
+    if !drain {
+        if !begin(1) {
+            return
+        }
+        defer end()
+    }
+
+    a.Lock()
+    var due []*window
+    for id, w := range a.windows {
+        if now.IsZero() || !w.due.After(now) {
+            due = append(due, w)
+            delete(a.windows, id)
+        }
+    }
+    m, locat := a.write, a.locat
+    a.Unlock()
+
+    if len(due) == 0 {
+        return
+    }
+    sort.Slice(due, func(i, j int) bool { return due[i].start.Before(due[j].start) })
+
+    //one batch per query and credentials of the writes
+    var order []string
+    groups := make(map[string][]string)
+    for _, w := range due {
+        group := w.query + "\x00" + w.auth
+        if _, ok := groups[group]; !ok {
+            order = append(order, group)
+        }
+        groups[group] = append(groups[group], w.lines(locat.Aggregate)...)
+    }
+
+    for _, group := range order {
+        parts := strings.SplitN(group, "\x00", 2)
+        b := &batch{auth: parts[1], query: parts[0], unit: time.Nanosecond, received: time.Now()}
+        lfields := logger.Fields{"stream":m.Listen,"location":locat.ID()}
+        m.deliver(locat, groups[group], b, lfields)
+    }
+}
+
+//lines returns the aggregates of a window in line protocol
+func (w *window) lines(conf *config.Aggregate) []string {
+    var buf bytes.Buffer
+    enc := protocol.NewEncoder(&buf)
+    enc.SetFieldSortOrder(protocol.SortFields)
+
+    encode := func(name string, fields map[string]interface{}) {
+        m, err := protocol.New(name, w.tags, fields, w.start)
+        if err == nil {
+            _, err = enc.Encode(m)
+        }
+        if err != nil {
+            logger.Errorf("aggregate: encoding %s: %v", name, err)
+        }
+    }
+
+    if conf.Output == "measurements" {
+        for _, function := range conf.Functions {
+            fields := make(map[string]interface{}, len(w.fields))
+            for key, s := range w.fields {
+                if value := s.value(function); value != nil {
+                    fields[key] = value
+                }
+            }
+            encode(w.name + conf.Suffix + "_" + function, fields)
+        }
+    } else {
+        fields := make(map[string]interface{}, len(w.fields) * len(conf.Functions))
+        for key, s := range w.fields {
+            for _, function := range conf.Functions {
+                if value := s.value(function); value != nil {
+                    fields[key + "_" + function] = value
+                }
+            }
+        }
+        encode(w.name + conf.Suffix, fields)
+    }
+
+    return strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+}
@@ -0,0 +1,50 @@
+package streams
+
+import (
+    "strconv"
+    "testing"
+    "time"
+    "github.com/ltkh/relay-server/internal/config"
+)
+
+func TestAggregate(t *testing.T) {
+    conf := &config.Aggregate{Period: 60, Grace: 3600, Functions: []string{"min", "max", "mean", "count"}, Output: "fields", Suffix: "_1m"}
+    a := &aggregator{locat: config.Location{Aggregate: conf}, windows: make(map[string]*window)}
+
+    start := time.Now().Truncate(time.Minute).Add(-time.Minute)
+    b := &batch{query: "db=test&precision=s", unit: time.Second, received: time.Now()}
+    sec := start.Unix()
+    a.add([]string{
+        "cpu,host=a value=1,state=\"up\" " + itoa(sec),
+        "cpu,host=a value=3 " + itoa(sec + 30),
+        "cpu,host=b value=5 " + itoa(sec + 59),
+        //a window hours ahead would stay open until then
+        "cpu,host=c value=7 " + itoa(sec + 3 * 3600),
+    }, b)
+
+    if len(a.windows) != 2 {
+        t.Fatalf("windows = %d, want 2 without the future one", len(a.windows))
+    }
+    var got []string
+    for _, w := range a.windows {
+        if w.query != "db=test" {
+            t.Errorf("query = %q, the precision belongs to the raw points", w.query)
+        }
+        got = append(got, w.lines(conf)...)
+    }
+
+    want := "cpu_1m,host=a value_count=2i,value_max=3,value_mean=2,value_min=1 " + itoa(start.UnixNano())
+    found := false
+    for _, line := range got {
+        if line == want {
+            found = true
+        }
+    }
+    if !found {
+        t.Errorf("lines = %q, want %q among them", got, want)
+    }
+}
+
+func itoa(n int64) string {
+    return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,304 @@
+package streams
+
+import (
+    "bufio"
+    "compress/gzip"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/ltkh/relay-server/internal/config"
+    "github.com/ltkh/relay-server/internal/logger"
+)
+
+var (
+    //archives holds the open files of every archive location
+    archivesMu   sync.Mutex
+    archives     = make(map[string]*archive)
+
+    dbEscaper    = strings.NewReplacer("/", "_", `\`, "_")
+    dateRegexp   = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}$`)
+
+    //archiveDirsMu keeps the cleanup of one location from removing a partition another one is
+    //creating a file in, locations may share a directory
+    archiveDirsMu sync.Mutex
+)
+
+//archive writes the batches of a location into one file per db and date partition
+type archive struct {
+    sync.Mutex
+    id           string
+    conf         config.Archive
+    files        map[string]*archiveFile
+    names        *regexp.Regexp
+}
+
+type archiveFile struct {
+    file         *os.File
+    gz           *gzip.Writer
+    out          *bufio.Writer
+    size         int64
+    opened       time.Time
+}
+
+//archiveOf returns the archive of a location, starting its rotation and cleanup on first use
+func archiveOf(locat config.Location) *archive {
+    archivesMu.Lock()
+    defer archivesMu.Unlock()
+
+    a, ok := archives[locat.ID()]
+    if !ok {
+        a = &archive{
+            id:    locat.ID(),
+            files: make(map[string]*archiveFile),
+            names: archiveNames(locat.ID()),
+        }
+        archives[locat.ID()] = a
+        go a.run()
+    }
+
+    a.Lock()
+    a.conf = *locat.Archive
+    a.Unlock()
+
+    return a
+}
+
+//archiveNames matches the names of the files of a location, not those of a location whose id starts the same
+func archiveNames(id string) *regexp.Regexp {
+    return regexp.MustCompile(`^` + regexp.QuoteMeta(id) + `-[0-9]{8}T[0-9]{6}\.[0-9]{9}\.lp(\.gz)?$`)
+}
+
+//CloseArchives closes the files of every archive location, once nothing is sent any more
+func CloseArchives() {
+    archivesMu.Lock()
+    defer archivesMu.Unlock()
+
+    for _, a := range archives {
+        a.Lock()
+        a.rotate(time.Time{})
+        a.Unlock()
+    }
+}
+
+//archiveLines writes lines to the archive of a location; timestamps are written in nanoseconds,
+//points without one get the receive time, so the files do not depend on the precision of the writes
+func archiveLines(locat config.Location, query string, lines []string, unit time.Duration, received time.Time) error {
+    params, _ := url.ParseQuery(query)
+
+    var buf strings.Builder
+    for _, line := range lines {
+        if line = strings.TrimRight(line, " \t\r"); line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if ts, ok := pointTime(line, unit); ok {
+            if unit != time.Nanosecond {
+                line = clamp(line, time.Nanosecond, ts)
+            }
+        } else {
+            line += " " + strconv.FormatInt(received.UnixNano(), 10)
+        }
+        buf.WriteString(line)
+        buf.WriteByte('\n')
+    }
+    if buf.Len() == 0 {
+        return nil
+    }
+
+    a := archiveOf(locat)
+    if err := a.write(params.Get("db"), buf.String(), received); err != nil {
+        return &SendError{Url: "file://" + a.conf.Directory, Code: http.StatusInternalServerError, Body: err.Error()}
+    }
+    return nil
+}
+
+func (a *archive) write(db string, data string, now time.Time) error {
+    if db = dbEscaper.Replace(db); db == "" || db == "." || db == ".." {
+        db = "_"
+    }
+    dir := filepath.Join(a.conf.Directory, db, now.UTC().Format("2006-01-02"))
+
+    a.Lock()
+    defer a.Unlock()
+
+    f := a.files[dir]
+    if f != nil && (f.size >= a.conf.Max_size || now.Sub(f.opened) >= a.conf.Rotate * time.Second) {
+        if err := f.close(); err != nil {
+            logger.With(logger.Fields{"location":a.id}).Errorf("closing archive file: %v", err)
+        }
+        delete(a.files, dir)
+        f = nil
+    }
+
+    if f == nil {
+        var err error
+        if f, err = a.open(dir, now); err != nil {
+            return err
+        }
+        a.files[dir] = f
+    }
+
+    n, err := f.out.WriteString(data)
+    f.size += int64(n)
+    if err == nil {
+        err = f.flush()
+    }
+    return err
+}
+
+//open creates a new file in a partition, named after the location and the time
+func (a *archive) open(dir string, now time.Time) (*archiveFile, error) {
+    name := a.id + "-" + now.UTC().Format("20060102T150405.000000000") + ".lp"
+    if a.conf.Compress {
+        name += ".gz"
+    }
+
+    archiveDirsMu.Lock()
+    err := os.MkdirAll(dir, 0755)
+    var file *os.File
+    if err == nil {
+        file, err = os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    }
+    archiveDirsMu.Unlock()
+    if err != nil {
+        return nil, err
+    }
+
+    f := &archiveFile{file: file, opened: now}
+    var w io.Writer = file
+    if a.conf.Compress {
+        f.gz = gzip.NewWriter(file)
+        w = f.gz
+    }
+    f.out = bufio.NewWriter(w)
+
+    return f, nil
+}
+
+//flush pushes the buffered lines, and a gzip block when compressing, into the file
+func (f *archiveFile) flush() error {
+    if err := f.out.Flush(); err != nil {
+        return err
+    }
+    if f.gz != nil {
+        return f.gz.Flush()
+    }
+    return nil
+}
+
+func (f *archiveFile) close() error {
+    err := f.flush()
+    if f.gz != nil {
+        if gerr := f.gz.Close(); err == nil {
+            err = gerr
+        }
+    }
+    if cerr := f.file.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+//run rotates the files and removes the expired ones every minute until the server stops
+func (a *archive) run() {
+    ticker := time.NewTicker(time.Minute)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-stopCtx.Done():
+            return
+        case now := <-ticker.C:
+            a.Lock()
+            a.rotate(now)
+            if a.conf.Retention > 0 {
+                a.cleanup(now)
+            }
+            a.Unlock()
+        }
+    }
+}
+
+//rotate closes the files due at now, of a past date or over their age; all of them when now is zero
+func (a *archive) rotate(now time.Time) {
+    for dir, f := range a.files {
+        if !now.IsZero() && filepath.Base(dir) == now.UTC().Format("2006-01-02") && now.Sub(f.opened) < a.conf.Rotate * time.Second {
+            continue
+        }
+        if err := f.close(); err != nil {
+            logger.With(logger.Fields{"location":a.id}).Errorf("closing archive file: %v", err)
+        }
+        delete(a.files, dir)
+    }
+}
+
+//cleanup removes the closed files of the location last written longer than the retention ago,
+//and the partitions left empty; only the <db>/<date> directories below the archive directory
+//are looked at, the files of other locations and anything else there are left alone
+func (a *archive) cleanup(now time.Time) {
+    conf := a.conf
+    open := make(map[string]bool, len(a.files))
+    for _, f := range a.files {
+        open[f.file.Name()] = true
+    }
+
+    dbs, err := ioutil.ReadDir(conf.Directory)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            logger.With(logger.Fields{"location":a.id}).Errorf("reading archive directory: %v", err)
+        }
+        return
+    }
+
+    cnt := 0
+    for _, db := range dbs {
+        if !db.IsDir() {
+            continue
+        }
+        dbDir := filepath.Join(conf.Directory, db.Name())
+        dates, err := ioutil.ReadDir(dbDir)
+        if err != nil {
+            continue
+        }
+        for _, date := range dates {
+            if !date.IsDir() || !dateRegexp.MatchString(date.Name()) {
+                continue
+            }
+            dateDir := filepath.Join(dbDir, date.Name())
+            files, err := ioutil.ReadDir(dateDir)
+            if err != nil {
+                continue
+            }
+            for _, info := range files {
+                path := filepath.Join(dateDir, info.Name())
+                if !info.Mode().IsRegular() || !a.names.MatchString(info.Name()) || open[path] || now.Sub(info.ModTime()) < conf.Retention * time.Second {
+                    continue
+                }
+                if err := os.Remove(path); err != nil {
+                    logger.With(logger.Fields{"location":a.id}).Errorf("removing archive file: %v", err)
+                } else {
+                    cnt++
+                }
+            }
+
+            //os.Remove leaves directories that are not empty
+            archiveDirsMu.Lock()
+            os.Remove(dateDir)
+            archiveDirsMu.Unlock()
+        }
+        archiveDirsMu.Lock()
+        os.Remove(dbDir)
+        archiveDirsMu.Unlock()
+    }
+
+    if cnt > 0 {
+        logger.With(logger.Fields{"location":a.id}).Infof("removed %d expired archive files", cnt)
+    }
+}
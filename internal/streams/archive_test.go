@@ -0,0 +1,88 @@
+package streams
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "github.com/ltkh/relay-server/internal/config"
+)
+
+func TestArchiveCleanup(t *testing.T) {
+    dir, err := ioutil.TempDir("", "archive")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    conf := &config.Archive{Directory: dir, Retention: 3600}
+    a := &archive{id: "audit", conf: *conf, files: make(map[string]*archiveFile), names: archiveNames("audit")}
+
+    old := time.Now().Add(-2 * time.Hour)
+    files := map[string]bool{
+        //expired files of the location are removed
+        "db/2024-01-01/audit-20240101T000000.000000000.lp":    true,
+        "db/2024-01-01/audit-20240101T010000.000000000.lp.gz": true,
+        //files of another location sharing the directory, whose name starts the same, are kept
+        "db/2024-01-01/audit-eu-20240101T000000.000000000.lp": false,
+        //as is anything that is not a partition of an archive
+        "db/notes/audit-20240101T000000.000000000.lp":         false,
+        "audit-20240101T000000.000000000.lp":                  false,
+    }
+    for name := range files {
+        path := filepath.Join(dir, name)
+        if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := ioutil.WriteFile(path, []byte("cpu value=1 1\n"), 0644); err != nil {
+            t.Fatal(err)
+        }
+        os.Chtimes(path, old, old)
+    }
+    //a recent file of the location stays as well
+    recent := filepath.Join(dir, "db", "2024-01-02", "audit-20240102T000000.000000000.lp")
+    os.MkdirAll(filepath.Dir(recent), 0755)
+    ioutil.WriteFile(recent, []byte("cpu value=1 1\n"), 0644)
+
+    a.cleanup(time.Now())
+
+    for name, removed := range files {
+        _, err := os.Stat(filepath.Join(dir, name))
+        if removed != os.IsNotExist(err) {
+            t.Errorf("%s: removed %v, want %v", name, os.IsNotExist(err), removed)
+        }
+    }
+    if _, err := os.Stat(recent); err != nil {
+        t.Errorf("recent file removed: %v", err)
+    }
+    if _, err := os.Stat(filepath.Join(dir, "db", "2024-01-01")); err != nil {
+        t.Errorf("partition with files of another location removed: %v", err)
+    }
+}
+
+func TestArchiveCleanupEmptyPartitions(t *testing.T) {
+    dir, err := ioutil.TempDir("", "archive")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    conf := &config.Archive{Directory: dir, Retention: 60}
+    a := &archive{id: "audit", conf: *conf, files: make(map[string]*archiveFile), names: archiveNames("audit")}
+
+    path := filepath.Join(dir, "db", "2024-01-01", "audit-20240101T000000.000000000.lp")
+    os.MkdirAll(filepath.Dir(path), 0755)
+    ioutil.WriteFile(path, []byte("cpu value=1 1\n"), 0644)
+    old := time.Now().Add(-time.Hour)
+    os.Chtimes(path, old, old)
+
+    a.cleanup(time.Now())
+
+    if _, err := os.Stat(filepath.Join(dir, "db")); !os.IsNotExist(err) {
+        t.Errorf("empty partitions kept: %v", err)
+    }
+    if _, err := os.Stat(dir); err != nil {
+        t.Errorf("archive directory removed: %v", err)
+    }
+}
@@ -0,0 +1,270 @@
+package streams
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "regexp"
+    "strings"
+    "time"
+    "github.com/ltkh/relay-server/internal/cache"
+    "github.com/ltkh/relay-server/internal/config"
+)
+
+//rejected keeps a batch a backend refused with a client error in the dead-letter store
+func rejected(store *cache.DeadLetter, query *Query, location string, serr *SendError) error {
+    if store == nil {
+        return nil
+    }
+
+    //letters are kept and shown for inspection, they hold no credentials; a redrive uses those of the location
+    kept := *query
+    kept.Auth, kept.Query = "", withoutCredentials(query.Query)
+    data, err := json.Marshal(&kept)
+    if err != nil {
+        return err
+    }
+
+    return store.Add(&cache.Letter{
+        Reason:   fmt.Sprintf("status_%d", serr.Code),
+        Url:      serr.Url,
+        Status:   serr.Code,
+        Response: serr.Body,
+        Entry:    &cache.Entry{
+            Stream:   query.Stream,
+            Location: location,
+            Failed:   time.Now(),
+            Attempts: 1,
+            Error:    serr.Error(),
+            Data:     data,
+        },
+    })
+}
+
+//DeadLetters serves the dead-letter store: listing, inspecting, re-driving and discarding batches
+//
+//  GET    /api/dead-letter              summaries of all letters
+//  GET    /api/dead-letter/<id>         one letter with its line protocol
+//  POST   /api/dead-letter/<id>/redrive send the batch again, optionally fixed up by regexps
+//  DELETE /api/dead-letter/<id>         discard the letter
+type DeadLetters struct {
+    Store        *cache.DeadLetter
+    Timeout      time.Duration
+    Config       func() *config.Config
+}
+
+//letterView is a letter with its batch decoded for reading
+type letterView struct {
+    *cache.Letter
+    Entry        *cache.Entry `json:"entry,omitempty"`
+    Location     string      `json:"location"`
+    Stream       string      `json:"stream"`
+    Urls         []string    `json:"urls"`
+    Query        string      `json:"query"`
+    Points       int         `json:"points"`
+    Body         string      `json:"body,omitempty"`
+}
+
+//Redrive is the optional request body of a redrive: regexps applied to every line before sending,
+//and urls to send to instead of the original ones, which must belong to a configured location
+type Redrive struct {
+    Regexp       []struct {
+        Match        string  `json:"match"`
+        Replace      string  `json:"replace"`
+    }                        `json:"regexp"`
+    Urls         []string    `json:"urls"`
+}
+
+func (d *DeadLetters) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/dead-letter"), "/")
+    parts := strings.Split(path, "/")
+
+    switch {
+    case path == "" && r.Method == http.MethodGet:
+        letters, err := d.Store.List()
+        if err != nil {
+            WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+            return
+        }
+        views := make([]*letterView, 0, len(letters))
+        for _, letter := range letters {
+            views = append(views, viewLetter(letter, false))
+        }
+        WriteJSON(w, http.StatusOK, views)
+
+    case len(parts) == 1 && r.Method == http.MethodGet:
+        letter, err := d.Store.Get(parts[0])
+        if err != nil {
+            WriteJSON(w, letterStatus(err), map[string]string{"error": err.Error()})
+            return
+        }
+        WriteJSON(w, http.StatusOK, viewLetter(letter, true))
+
+    case len(parts) == 1 && r.Method == http.MethodDelete:
+        if err := d.Store.Remove(parts[0]); err != nil {
+            WriteJSON(w, letterStatus(err), map[string]string{"error": err.Error()})
+            return
+        }
+        WriteJSON(w, http.StatusOK, map[string]string{"status": "discarded"})
+
+    case len(parts) == 2 && parts[1] == "redrive" && r.Method == http.MethodPost:
+        code, err := d.redrive(parts[0], r)
+        if err != nil {
+            WriteJSON(w, code, map[string]string{"error": err.Error()})
+            return
+        }
+        WriteJSON(w, http.StatusOK, map[string]string{"status": "delivered"})
+
+    default:
+        WriteJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+    }
+}
+
+//redrive sends a letter again and removes it once a backend accepted it
+func (d *DeadLetters) redrive(id string, r *http.Request) (int, error) {
+    letter, err := d.Store.Get(id)
+    if err != nil {
+        return letterStatus(err), err
+    }
+
+    fix := &Redrive{}
+    body, err := ioutil.ReadAll(r.Body)
+    if err != nil {
+        return http.StatusBadRequest, err
+    }
+    defer r.Body.Close()
+    if len(strings.TrimSpace(string(body))) > 0 {
+        if err := json.Unmarshal(body, fix); err != nil {
+            return http.StatusBadRequest, err
+        }
+    }
+
+    var query *Query
+    if err := json.Unmarshal(letter.Entry.Data, &query); err != nil {
+        return http.StatusInternalServerError, err
+    }
+
+    if len(fix.Regexp) > 0 {
+        lines := strings.Split(string(query.Body), "\n")
+        for _, rexp := range fix.Regexp {
+            re, err := regexp.Compile(rexp.Match)
+            if err != nil {
+                return http.StatusBadRequest, err
+            }
+            for k, line := range lines {
+                lines[k] = re.ReplaceAllString(line, rexp.Replace)
+            }
+        }
+        query.Body = []byte(strings.Join(lines, "\n"))
+    }
+    var cfg *config.Config
+    if d.Config != nil {
+        cfg = d.Config()
+    }
+    own, configured := config.Location{}, false
+    if cfg != nil {
+        own, configured = cfg.Location(letter.Entry.Location)
+    }
+
+    if len(fix.Urls) > 0 {
+        //credentials never go to urls of another location than the one they were sent with
+        if configured && containsAll(own.Urls, fix.Urls) {
+            query.Urls = fix.Urls
+        } else if locat, ok := urlsLocation(cfg, fix.Urls); ok {
+            query.Urls = fix.Urls
+            query.Auth = locationAuth(locat, "")
+        } else {
+            return http.StatusBadRequest, fmt.Errorf("urls %v do not belong to one configured location", fix.Urls)
+        }
+    } else if configured && len(own.Urls) > 0 {
+        query.Urls = own.Urls
+    }
+    if query.Auth == "" && configured {
+        query.Auth = locationAuth(own, "")
+    }
+
+    if err := Sender(query, NoRetry, d.Timeout, nil); err != nil {
+        return http.StatusBadGateway, err
+    }
+
+    return http.StatusOK, d.Store.Remove(id)
+}
+
+//urlsLocation returns the configured location sending to every one of the urls
+func urlsLocation(cfg *config.Config, urls []string) (config.Location, bool) {
+    if cfg == nil {
+        return config.Location{}, false
+    }
+    for _, stream := range cfg.Write.Streams {
+        for _, locat := range stream.Locations {
+            if containsAll(locat.Urls, urls) {
+                return locat, true
+            }
+        }
+    }
+    return config.Location{}, false
+}
+
+//containsAll tells whether every one of values is in list
+func containsAll(list, values []string) bool {
+    for _, value := range values {
+        found := false
+        for _, item := range list {
+            if item == value {
+                found = true
+                break
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+    return true
+}
+
+func viewLetter(letter *cache.Letter, full bool) *letterView {
+    view := &letterView{Letter: letter}
+    if letter.Entry == nil {
+        return view
+    }
+    view.Location, view.Stream = letter.Entry.Location, letter.Entry.Stream
+
+    var query *Query
+    if err := json.Unmarshal(letter.Entry.Data, &query); err == nil {
+        view.Urls, view.Query = query.Urls, withoutCredentials(query.Query)
+        view.Points = CountPoints(strings.Split(string(query.Body), "\n"))
+        if full {
+            view.Body = string(query.Body)
+        }
+    }
+
+    return view
+}
+
+//withoutCredentials removes the u and p parameters of the influxdb 1.x api from a query string
+func withoutCredentials(query string) string {
+    params, err := url.ParseQuery(query)
+    if err != nil {
+        return ""
+    }
+    params.Del("u")
+    params.Del("p")
+    return params.Encode()
+}
+
+func letterStatus(err error) int {
+    if os.IsNotExist(err) {
+        return http.StatusNotFound
+    }
+    return http.StatusBadRequest
+}
+
+//WriteJSON answers with v encoded as JSON
+func WriteJSON(w http.ResponseWriter, code int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(v)
+}
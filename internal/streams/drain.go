@@ -0,0 +1,78 @@
+package streams
+
+import (
+    "context"
+    "sync"
+    "time"
+)
+
+var (
+    //flights counts the sends and replays still running
+    flights      sync.WaitGroup
+    flightMu     sync.Mutex
+    draining     bool
+    //stopCtx is cancelled once the drain timeout is over, senders then give up and cache their batches
+    stopCtx, stop = context.WithCancel(context.Background())
+)
+
+//begin registers n sends, it fails once the server is draining
+func begin(n int) bool {
+    flightMu.Lock()
+    defer flightMu.Unlock()
+
+    if draining {
+        return false
+    }
+    flights.Add(n)
+    return true
+}
+
+func end() {
+    flights.Done()
+}
+
+//stopped reports whether senders must give up
+func stopped() bool {
+    return stopCtx.Err() != nil
+}
+
+//Drain refuses new sends and waits up to timeout seconds for the running ones to finish, then sends
+//the open aggregate windows, complete by then, within the same timeout; senders still retrying after
+//that are cancelled and cache their batches, it reports whether none was cancelled
+func Drain(timeout time.Duration) bool {
+    flightMu.Lock()
+    draining = true
+    flightMu.Unlock()
+
+    deadline := time.After(timeout * time.Second)
+    wait := func() bool {
+        done := make(chan struct{})
+        go func() {
+            flights.Wait()
+            close(done)
+        }()
+
+        select {
+        case <-done:
+            return true
+        case <-deadline:
+        }
+
+        stop()
+        <-done
+        return false
+    }
+
+    if !wait() {
+        flushDrained()
+        return false
+    }
+
+    flights.Add(1)
+    go func() {
+        defer flights.Done()
+        flushDrained()
+    }()
+
+    return wait()
+}
@@ -0,0 +1,244 @@
+package streams
+
+import (
+    "bytes"
+    "fmt"
+    "net/url"
+    "runtime"
+    "sort"
+    "strings"
+    "time"
+    "github.com/influxdata/line-protocol"
+    "github.com/ltkh/relay-server/internal/cache"
+    "github.com/ltkh/relay-server/internal/config"
+    "github.com/ltkh/relay-server/internal/logger"
+    "github.com/prometheus/client_golang/prometheus"
+    dto "github.com/prometheus/client_model/go"
+)
+
+var (
+    started = time.Now()
+    //emitTags renames the metric labels that have a better known name as tags
+    emitTags = map[string]string{"listen": "stream"}
+    //emitSkip lists the labels left out of the tags, series that only differ in them are summed;
+    //a request uri may carry the u and p credentials of the influxdb 1.x api, it is never written
+    emitSkip = map[string]bool{"rhost": true, "uri": true}
+)
+
+//Emitter writes the metrics of the server as line protocol into a location, through the same
+//rewrites, retries and cache as the batches of the streams; the self_monitor section and the
+//location are taken from the config on every run, so reloads apply to them
+type Emitter struct {
+    Config       func() *config.Config
+    Hostname     string
+    Cache        *cache.Cache
+}
+
+//interval returns the emit interval of the config, a minute while self-monitoring is off
+func (e *Emitter) interval() time.Duration {
+    if sm := e.Config().Monit.Self_monitor; sm != nil && sm.Interval > 0 {
+        return sm.Interval * time.Second
+    }
+    return time.Minute
+}
+
+//Run emits the metrics every interval until the server is drained
+func (e *Emitter) Run() {
+    interval := e.interval()
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-stopCtx.Done():
+            return
+        case now := <-ticker.C:
+            if err := e.Emit(now); err != nil {
+                logger.With(logger.Fields{"stream":"self"}).Errorf("emitting self-monitoring metrics: %v", err)
+            }
+            if next := e.interval(); next != interval {
+                interval = next
+                ticker.Reset(interval)
+            }
+        }
+    }
+}
+
+//Emit sends one set of metrics taken at now, nothing when the config has no self_monitor section
+func (e *Emitter) Emit(now time.Time) error {
+    cfg := e.Config()
+    sm := cfg.Monit.Self_monitor
+    if sm == nil {
+        return nil
+    }
+    locat, ok := cfg.Location(sm.Location)
+    if !ok {
+        return fmt.Errorf("self_monitor location %q is not configured", sm.Location)
+    }
+
+    body, err := e.gather(now)
+    if err != nil {
+        return err
+    }
+
+    if !begin(1) {
+        return nil
+    }
+    defer end()
+
+    params := url.Values{"db": {sm.Database}}
+    if sm.Retention_policy != "" {
+        params.Set("rp", sm.Retention_policy)
+    }
+    lines := Transform(locat, strings.Split(strings.TrimRight(string(body), "\n"), "\n"), "")
+    query := &Query{
+        Stream: "self",
+        Urls:   locat.Urls,
+        Auth:   locationAuth(locat, ""),
+        Query:  params.Encode(),
+        Body:   []byte(strings.Join(lines, "\n")),
+        Fields: logger.Fields{"stream":"self","location":locat.ID()},
+    }
+
+    var wal *cache.WAL
+    if locat.Cache && e.Cache != nil && locat.Archive == nil {
+        if wal, err = e.Cache.Location(locat.ID()); err != nil {
+            logger.With(query.Fields).Errorf("opening cache: %v", err)
+        }
+    }
+
+    if locat.Archive != nil {
+        err = archiveLines(locat, query.Query, lines, time.Nanosecond, now)
+        delivered(locat.ID(), CountPoints(lines), err)
+        return err
+    }
+
+    policy, timeout := sendPolicy(locat, cfg.Write.Retry, cfg.Write.Repeat, cfg.Write.Timeout, cfg.Write.Delay_time)
+    err = Sender(query, policy, timeout, wal)
+    delivered(locat.ID(), CountPoints(lines), err)
+    if serr, ok := err.(*SendError); ok && serr.Cached {
+        return nil
+    }
+
+    return err
+}
+
+//series is a metric of a family with its tags, the values of the series it stands for are summed
+type series struct {
+    tags         map[string]string
+    fields       map[string]float64
+}
+
+//gather turns the relay_server_* metrics and the runtime statistics into line protocol
+func (e *Emitter) gather(now time.Time) ([]byte, error) {
+    families, err := prometheus.DefaultGatherer.Gather()
+    if err != nil {
+        return nil, err
+    }
+
+    var buf bytes.Buffer
+    enc := protocol.NewEncoder(&buf)
+    enc.SetFieldSortOrder(protocol.SortFields)
+
+    add := func(name string, tags map[string]string, fields map[string]interface{}) {
+        tags["hostname"] = e.Hostname
+        m, err := protocol.New(name, tags, fields, now)
+        if err == nil {
+            _, err = enc.Encode(m)
+        }
+        if err != nil {
+            logger.With(logger.Fields{"stream":"self"}).Errorf("encoding self-monitoring metric %s: %v", name, err)
+        }
+    }
+
+    for _, family := range families {
+        if !strings.HasPrefix(family.GetName(), "relay_server_") {
+            continue
+        }
+        var keys []string
+        merged := make(map[string]*series)
+        for _, metric := range family.GetMetric() {
+            tags := make(map[string]string)
+            for _, label := range metric.GetLabel() {
+                if label.GetValue() == "" || emitSkip[label.GetName()] {
+                    continue
+                }
+                name := label.GetName()
+                if tag, ok := emitTags[name]; ok {
+                    name = tag
+                }
+                tags[name] = label.GetValue()
+            }
+
+            fields := make(map[string]float64)
+            switch family.GetType() {
+            case dto.MetricType_COUNTER:
+                fields["value"] = metric.GetCounter().GetValue()
+            case dto.MetricType_GAUGE:
+                fields["value"] = metric.GetGauge().GetValue()
+            case dto.MetricType_UNTYPED:
+                fields["value"] = metric.GetUntyped().GetValue()
+            case dto.MetricType_HISTOGRAM:
+                fields["count"] = float64(metric.GetHistogram().GetSampleCount())
+                fields["sum"] = metric.GetHistogram().GetSampleSum()
+            case dto.MetricType_SUMMARY:
+                fields["count"] = float64(metric.GetSummary().GetSampleCount())
+                fields["sum"] = metric.GetSummary().GetSampleSum()
+            }
+
+            key := seriesKey(tags)
+            if s, ok := merged[key]; ok {
+                for field, value := range fields {
+                    s.fields[field] += value
+                }
+                continue
+            }
+            keys = append(keys, key)
+            merged[key] = &series{tags: tags, fields: fields}
+        }
+        for _, key := range keys {
+            s := merged[key]
+            fields := make(map[string]interface{}, len(s.fields))
+            for field, value := range s.fields {
+                if field == "count" {
+                    fields[field] = uint64(value)
+                } else {
+                    fields[field] = value
+                }
+            }
+            add(family.GetName(), s.tags, fields)
+        }
+    }
+
+    var mem runtime.MemStats
+    runtime.ReadMemStats(&mem)
+    add("relay_server_runtime", map[string]string{}, map[string]interface{}{
+        "uptime_seconds":         time.Since(started).Seconds(),
+        "goroutines":             int64(runtime.NumGoroutine()),
+        "heap_alloc_bytes":       mem.HeapAlloc,
+        "heap_inuse_bytes":       mem.HeapInuse,
+        "sys_bytes":              mem.Sys,
+        "gc_count":               int64(mem.NumGC),
+        "gc_pause_total_seconds": float64(mem.PauseTotalNs) / 1e9,
+    })
+
+    return buf.Bytes(), nil
+}
+
+//seriesKey returns the tags in a stable order
+func seriesKey(tags map[string]string) string {
+    names := make([]string, 0, len(tags))
+    for name := range tags {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var b strings.Builder
+    for _, name := range names {
+        b.WriteString(name)
+        b.WriteByte('=')
+        b.WriteString(tags[name])
+        b.WriteByte(',')
+    }
+    return b.String()
+}
@@ -0,0 +1,142 @@
+package streams
+
+import (
+    "sort"
+    "strings"
+    "github.com/ltkh/relay-server/internal/config"
+)
+
+var (
+    tagEscaper   = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+    tagUnescaper = strings.NewReplacer(`\,`, `,`, `\=`, `=`, `\ `, ` `, `\\`, `\`)
+)
+
+//Transform applies the processors of a location to a copy of the lines: the rewrites, the enrichment
+//and the redaction
+func Transform(locat config.Location, lines []string, client string) []string {
+    return Redact(locat, Enrich(locat, Process(locat, lines), client))
+}
+
+//Enrich adds the static, client and lookup tags of a location to the lines
+func Enrich(locat config.Location, lines []string, client string) []string {
+    e := locat.Enrich
+    if e == nil {
+        return lines
+    }
+
+    tables := make([]*table, len(e.Lookups))
+    for i := range e.Lookups {
+        tables[i] = lookupTable(&e.Lookups[i])
+        tables[i].refresh()
+    }
+
+    nlines := make([]string, len(lines))
+    for i, line := range lines {
+        nlines[i] = line
+
+        end := seriesEnd(line)
+        if end <= 0 || strings.HasPrefix(line, "#") {
+            continue
+        }
+        name, pairs := splitTags(line[:end])
+        tags := tagMap(pairs)
+
+        add := make(map[string]string, len(e.Tags) + 1)
+        for key, value := range e.Tags {
+            add[key] = value
+        }
+        if e.Client_tag != "" && client != "" {
+            add[e.Client_tag] = client
+        }
+        for n, lookup := range e.Lookups {
+            row, ok := tables[n].get(tags)
+            if !ok {
+                row = lookup.Default
+            }
+            for key, value := range row {
+                add[key] = value
+            }
+        }
+
+        nlines[i] = withTags(name, pairs, tags, add) + line[end:]
+    }
+
+    return nlines
+}
+
+//seriesEnd returns the index of the space after the measurement and tags of a line, -1 when there is none
+func seriesEnd(line string) int {
+    for i := 0; i < len(line); i++ {
+        switch line[i] {
+        case '\\':
+            i++
+        case ' ':
+            return i
+        }
+    }
+    return -1
+}
+
+//splitTags splits a series key at its unescaped commas into the measurement and the tag pairs
+func splitTags(series string) (string, []string) {
+    var parts []string
+    start := 0
+    for i := 0; i < len(series); i++ {
+        switch series[i] {
+        case '\\':
+            i++
+        case ',':
+            parts = append(parts, series[start:i])
+            start = i + 1
+        }
+    }
+    parts = append(parts, series[start:])
+    return parts[0], parts[1:]
+}
+
+//tagKey returns the escaped key of a tag pair
+func tagKey(pair string) string {
+    for i := 0; i < len(pair); i++ {
+        switch pair[i] {
+        case '\\':
+            i++
+        case '=':
+            return pair[:i]
+        }
+    }
+    return pair
+}
+
+//tagMap returns the unescaped tags of the pairs
+func tagMap(pairs []string) map[string]string {
+    tags := make(map[string]string, len(pairs))
+    for _, pair := range pairs {
+        key := tagKey(pair)
+        value := ""
+        if len(key) < len(pair) {
+            value = pair[len(key)+1:]
+        }
+        tags[tagUnescaper.Replace(key)] = tagUnescaper.Replace(value)
+    }
+    return tags
+}
+
+//withTags returns the series key with the tags of add the point does not have yet, sorted by key
+func withTags(name string, pairs []string, tags map[string]string, add map[string]string) string {
+    added := false
+    for key, value := range add {
+        if _, ok := tags[key]; ok || key == "" || value == "" {
+            continue
+        }
+        pairs = append(pairs, tagEscaper.Replace(key) + "=" + tagEscaper.Replace(value))
+        added = true
+    }
+    if !added {
+        return strings.Join(append([]string{name}, pairs...), ",")
+    }
+
+    sort.Slice(pairs, func(i, j int) bool {
+        return tagUnescaper.Replace(tagKey(pairs[i])) < tagUnescaper.Replace(tagKey(pairs[j]))
+    })
+    return name + "," + strings.Join(pairs, ",")
+}
@@ -0,0 +1,48 @@
+package streams
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "github.com/ltkh/relay-server/internal/config"
+)
+
+func TestEnrich(t *testing.T) {
+    dir, err := ioutil.TempDir("", "lookup")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    //key values holding the old separator must not match each other
+    file := filepath.Join(dir, "hosts.csv")
+    if err := ioutil.WriteFile(file, []byte("host,rack,dc\n\"a,b\",c,east\na,\"b,c\",west\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    locat := config.Location{Enrich: &config.Enrich{
+        Tags:       map[string]string{"env": "prod", "host": "ignored"},
+        Client_tag: "client_ip",
+        Lookups:    []config.Lookup{{File: file, Keys: []string{"host", "rack"}, Default: map[string]string{"dc": "unknown"}}},
+    }}
+    lines := []string{
+        `cpu,host=a\,b,rack=c value=1 1`,
+        `cpu,host=a,rack=b\,c value=1 1`,
+        `cpu,host=x,rack=y value=1 1`,
+        `# comment`,
+    }
+    want := []string{
+        `cpu,client_ip=10.0.0.1,dc=east,env=prod,host=a\,b,rack=c value=1 1`,
+        `cpu,client_ip=10.0.0.1,dc=west,env=prod,host=a,rack=b\,c value=1 1`,
+        `cpu,client_ip=10.0.0.1,dc=unknown,env=prod,host=x,rack=y value=1 1`,
+        `# comment`,
+    }
+
+    got := Enrich(locat, lines, "10.0.0.1")
+    for i := range want {
+        if got[i] != want[i] {
+            t.Errorf("line %d = %q, want %q", i, got[i], want[i])
+        }
+    }
+}
@@ -0,0 +1,108 @@
+package streams
+
+import (
+    "strconv"
+    "strings"
+    "time"
+    "github.com/ltkh/relay-server/internal/config"
+    "github.com/ltkh/relay-server/internal/monitor"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+//precisions maps the precision parameter of a write to the unit of its timestamps
+var precisions = map[string]time.Duration{
+    "":   time.Nanosecond,
+    "n":  time.Nanosecond,
+    "ns": time.Nanosecond,
+    "u":  time.Microsecond,
+    "us": time.Microsecond,
+    "ms": time.Millisecond,
+    "s":  time.Second,
+    "m":  time.Minute,
+    "h":  time.Hour,
+}
+
+//precision returns the unit of the timestamps of a write, nanoseconds when the parameter is unknown
+func precision(param string) time.Duration {
+    if unit, ok := precisions[param]; ok {
+        return unit
+    }
+    return time.Nanosecond
+}
+
+//pointTime returns the timestamp of a line, ok is false when the line has none
+func pointTime(line string, unit time.Duration) (time.Time, bool) {
+    line = strings.TrimRight(line, " \t\r")
+    i := strings.LastIndexByte(line, ' ')
+    if i <= 0 {
+        return time.Time{}, false
+    }
+    ts, err := strconv.ParseInt(line[i+1:], 10, 64)
+    if err != nil {
+        return time.Time{}, false
+    }
+    if unit >= time.Second {
+        return time.Unix(ts * int64(unit / time.Second), 0), true
+    }
+    return time.Unix(0, ts * int64(unit)), true
+}
+
+//measurement returns the unescaped measurement name of a line
+func measurement(line string) string {
+    for i := 0; i < len(line); i++ {
+        switch line[i] {
+        case '\\':
+            i++
+        case ',', ' ':
+            line = line[:i]
+        }
+    }
+    return strings.NewReplacer(`\ `, ` `, `\,`, `,`, `\\`, `\`).Replace(line)
+}
+
+//freshness observes the time between the timestamp of every point and the receipt of the write,
+//counting the points dated too far ahead or back
+func freshness(listen string, conf *config.Freshness, lines []string, unit time.Duration, received time.Time) {
+    if conf == nil {
+        return
+    }
+
+    measurements := make(map[string]bool, len(conf.Measurements))
+    for _, name := range conf.Measurements {
+        measurements[name] = true
+    }
+
+    future, late := 0, 0
+    for _, line := range lines {
+        ts, ok := pointTime(line, unit)
+        if !ok {
+            continue
+        }
+
+        delay := received.Sub(ts)
+        if delay < -conf.Future * time.Second {
+            future++
+        }
+        if delay > conf.Late * time.Second {
+            late++
+        }
+        if delay < 0 {
+            continue
+        }
+
+        name := ""
+        if len(measurements) > 0 {
+            if name = measurement(line); !measurements[name] {
+                name = ""
+            }
+        }
+        monitor.IngestDelay.With(prometheus.Labels{"listen":listen,"measurement":name}).Observe(delay.Seconds())
+    }
+
+    if future > 0 {
+        monitor.FuturePoints.With(prometheus.Labels{"listen":listen}).Add(float64(future))
+    }
+    if late > 0 {
+        monitor.LatePoints.With(prometheus.Labels{"listen":listen}).Add(float64(late))
+    }
+}
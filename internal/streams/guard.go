@@ -0,0 +1,118 @@
+package streams
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/ltkh/relay-server/internal/config"
+    "github.com/ltkh/relay-server/internal/logger"
+    "github.com/ltkh/relay-server/internal/monitor"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+    //offenders holds per client and guard when points out of the window were last logged,
+    //and how many were seen since
+    offendersMu  sync.Mutex
+    offenders    = make(map[string]*offense)
+)
+
+type offense struct {
+    logged       time.Time
+    points       int
+    //interval is the log interval of the guard the offense was seen by
+    interval     time.Duration
+}
+
+//guard applies a timestamp guard to the lines of a write; it returns the lines to send on, with the
+//offending ones dropped, clamped to the receive time or, for the reroute action, returned apart;
+//with redacted set no offending point is logged
+func guard(g *config.Timestamp_guard, lines []string, unit time.Duration, received time.Time, listen string, location string, redacted bool, fields logger.Fields) ([]string, []string) {
+    if g == nil {
+        return lines, nil
+    }
+
+    var kept, rerouted []string
+    var example string
+    cnt := 0
+
+    for _, line := range lines {
+        ts, ok := pointTime(line, unit)
+        if !ok {
+            kept = append(kept, line)
+            continue
+        }
+
+        reason := ""
+        switch delay := received.Sub(ts); {
+        case g.Max_future > 0 && delay < -g.Max_future * time.Second:
+            reason = "future"
+        case g.Max_past > 0 && delay > g.Max_past * time.Second:
+            reason = "past"
+        }
+        if reason == "" {
+            kept = append(kept, line)
+            continue
+        }
+
+        monitor.GuardedPoints.With(prometheus.Labels{"listen":listen,"location":location,"reason":reason,"action":g.Action}).Inc()
+        if cnt == 0 && !redacted {
+            example = line
+        }
+        cnt++
+
+        switch g.Action {
+        case "clamp":
+            kept = append(kept, clamp(line, unit, received))
+        case "reroute":
+            rerouted = append(rerouted, line)
+        }
+    }
+
+    if cnt > 0 {
+        sample(g, cnt, example, listen + "|" + location + "|" + fmt.Sprint(fields["client"]), fields)
+    }
+
+    return kept, rerouted
+}
+
+//clamp replaces the timestamp of a line with t
+func clamp(line string, unit time.Duration, t time.Time) string {
+    line = strings.TrimRight(line, " \t\r")
+    i := strings.LastIndexByte(line, ' ')
+    return line[:i+1] + strconv.FormatInt(t.UnixNano() / int64(unit), 10)
+}
+
+//sample logs the offending points of a client at most once per log interval of the guard, with
+//an example unless it is empty
+func sample(g *config.Timestamp_guard, cnt int, example string, key string, fields logger.Fields) {
+    offendersMu.Lock()
+    off, ok := offenders[key]
+    if !ok {
+        off = &offense{}
+        offenders[key] = off
+    }
+    off.points += cnt
+    off.interval = g.Log_interval * time.Second
+    if time.Since(off.logged) < off.interval {
+        offendersMu.Unlock()
+        return
+    }
+    points := off.points
+    off.logged, off.points = time.Now(), 0
+    for k, o := range offenders {
+        //clients that stopped offending are forgotten, whatever they sent since the last report
+        if time.Since(o.logged) > o.interval {
+            delete(offenders, k)
+        }
+    }
+    offendersMu.Unlock()
+
+    if example == "" {
+        logger.With(fields).Warnf("timestamp guard: %d points out of the window (%s) since the last report", points, g.Action)
+        return
+    }
+    logger.With(fields).Warnf("timestamp guard: %d points out of the window (%s) since the last report, e.g. %q", points, g.Action, example)
+}
@@ -0,0 +1,32 @@
+package streams
+
+import (
+    "net/http"
+    "sync/atomic"
+)
+
+//Handler serves a stream through a Write that can be replaced while requests are in flight,
+//every request keeps the settings it started with
+type Handler struct {
+    write        atomic.Value
+}
+
+func NewHandler(write *Write) *Handler {
+    h := &Handler{}
+    h.Store(write)
+    return h
+}
+
+//Store switches the handler to new settings
+func (h *Handler) Store(write *Write) {
+    h.write.Store(write)
+}
+
+//Load returns the current settings
+func (h *Handler) Load() *Write {
+    return h.write.Load().(*Write)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    h.Load().ServeHTTP(w, r)
+}
@@ -0,0 +1,177 @@
+package streams
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+    "github.com/ltkh/relay-server/internal/config"
+    "github.com/ltkh/relay-server/internal/logger"
+)
+
+var (
+    //tables holds the lookup tables by file and keys, shared by every location using them
+    tablesMu     sync.Mutex
+    tables       = make(map[string]*table)
+)
+
+//keySeparator joins the key values of a row, it can not be part of a tag value
+const keySeparator = "\x00"
+
+//table is a lookup file read into rows of tags by the values of its key columns
+type table struct {
+    sync.RWMutex
+    file         string
+    keys         []string
+    reload       time.Duration
+    rows         map[string]map[string]string
+    modTime      time.Time
+    checked      time.Time
+}
+
+//lookupTable returns the table of a lookup, reading the file on first use
+func lookupTable(lookup *config.Lookup) *table {
+    id := lookup.File + "|" + strings.Join(lookup.Keys, ",")
+
+    tablesMu.Lock()
+    defer tablesMu.Unlock()
+
+    t, ok := tables[id]
+    if !ok {
+        t = &table{file: lookup.File, keys: lookup.Keys}
+        tables[id] = t
+    }
+    t.Lock()
+    t.reload = lookup.Reload * time.Second
+    t.Unlock()
+    return t
+}
+
+//refresh reads the file again when it changed since the last read, at most once per reload interval;
+//the rows read last stay in use when the file is missing or broken
+func (t *table) refresh() {
+    //the write lock blocks every lookup of the table, it is only taken when a check is due
+    t.RLock()
+    due := t.due()
+    t.RUnlock()
+    if !due {
+        return
+    }
+
+    t.Lock()
+    defer t.Unlock()
+
+    if !t.due() {
+        return
+    }
+    t.checked = time.Now()
+
+    info, err := os.Stat(t.file)
+    if err != nil {
+        logger.Errorf("reading lookup table: %v", err)
+        return
+    }
+    if info.ModTime().Equal(t.modTime) {
+        return
+    }
+
+    rows, err := readTable(t.file, t.keys)
+    if err != nil {
+        logger.Errorf("reading lookup table: %s: %v", t.file, err)
+        return
+    }
+    t.rows, t.modTime = rows, info.ModTime()
+    logger.Infof("lookup table loaded: %s (%d rows)", t.file, len(rows))
+}
+
+//due reports whether the file should be checked for changes, the caller holds a lock of the table
+func (t *table) due() bool {
+    return t.checked.IsZero() || time.Since(t.checked) >= t.reload
+}
+
+//get returns the row matching the key tags, ok is false when a key tag is missing or no row matches
+func (t *table) get(tags map[string]string) (map[string]string, bool) {
+    values := make([]string, len(t.keys))
+    for i, key := range t.keys {
+        value, ok := tags[key]
+        if !ok {
+            return nil, false
+        }
+        values[i] = value
+    }
+
+    t.RLock()
+    defer t.RUnlock()
+    row, ok := t.rows[strings.Join(values, keySeparator)]
+    return row, ok
+}
+
+//readTable reads a csv file with a header line or a json array of objects; the columns named by keys
+//make up the key of a row, the other non-empty ones its tags
+func readTable(file string, keys []string) (map[string]map[string]string, error) {
+    f, err := os.Open(file)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var records []map[string]string
+
+    if strings.ToLower(filepath.Ext(file)) == ".json" {
+        var objects []map[string]interface{}
+        if err := json.NewDecoder(f).Decode(&objects); err != nil {
+            return nil, err
+        }
+        for _, object := range objects {
+            record := make(map[string]string, len(object))
+            for column, value := range object {
+                if value != nil {
+                    record[column] = fmt.Sprint(value)
+                }
+            }
+            records = append(records, record)
+        }
+    } else {
+        reader := csv.NewReader(f)
+        reader.TrimLeadingSpace = true
+        lines, err := reader.ReadAll()
+        if err != nil {
+            return nil, err
+        }
+        if len(lines) == 0 {
+            return nil, fmt.Errorf("no header line")
+        }
+        for _, line := range lines[1:] {
+            record := make(map[string]string, len(line))
+            for i, column := range lines[0] {
+                record[strings.TrimSpace(column)] = strings.TrimSpace(line[i])
+            }
+            records = append(records, record)
+        }
+    }
+
+    rows := make(map[string]map[string]string, len(records))
+    for n, record := range records {
+        values := make([]string, len(keys))
+        for i, key := range keys {
+            value, ok := record[key]
+            if !ok {
+                return nil, fmt.Errorf("row %d has no %q column", n + 1, key)
+            }
+            values[i] = value
+            delete(record, key)
+        }
+        for column, value := range record {
+            if value == "" {
+                delete(record, column)
+            }
+        }
+        rows[strings.Join(values, keySeparator)] = record
+    }
+
+    return rows, nil
+}
@@ -0,0 +1,49 @@
+package streams
+
+import (
+    "net/http"
+    "strings"
+    "sync"
+    "github.com/ltkh/relay-server/internal/cache"
+    "github.com/ltkh/relay-server/internal/logger"
+)
+
+var (
+    //paused holds the locations whose batches are not sent until they are resumed
+    paused sync.Map
+)
+
+//Pause stops sending to a location, its batches go to the cache when it has one
+//and are dropped otherwise; cache replay of the location waits as well
+func Pause(id string) {
+    if _, was := paused.LoadOrStore(id, true); !was {
+        logger.With(logger.Fields{"location":id}).Infof("location paused")
+    }
+}
+
+//Resume sends to a paused location again
+func Resume(id string) {
+    if _, was := paused.Load(id); was {
+        paused.Delete(id)
+        logger.With(logger.Fields{"location":id}).Infof("location resumed")
+    }
+}
+
+//Paused reports whether a location is paused
+func Paused(id string) bool {
+    _, ok := paused.Load(id)
+    return ok
+}
+
+//hold keeps the batch of a paused location in its cache
+func hold(query *Query, wal *cache.WAL) error {
+    serr := &SendError{Url: strings.Join(query.Urls, ","), Code: http.StatusServiceUnavailable, Body: "location paused"}
+    if wal != nil {
+        if err := cacheWrite(query, wal, 0, serr.Body); err != nil {
+            logger.With(query.Fields).Errorf("writing cache: %v", err)
+        } else {
+            serr.Cached = true
+        }
+    }
+    return serr
+}
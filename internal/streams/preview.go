@@ -0,0 +1,67 @@
+package streams
+
+import (
+    "net/url"
+    "sort"
+    "time"
+    "github.com/ltkh/relay-server/internal/config"
+    "github.com/ltkh/relay-server/internal/logger"
+)
+
+//LocationPreview is what a location would do with the lines of a write
+type LocationPreview struct {
+    Location     config.Location
+    //Sent holds the lines sent to the backends right away
+    Sent         []string
+    //Aggregated holds the rollups the windows opened by the write would send
+    Aggregated   []string
+    //Rerouted holds the lines the timestamp guard of the location sends elsewhere
+    Rerouted     []string
+}
+
+//Preview runs lines through the same timestamp guards, transformations and aggregation as a write
+//to the stream, without sending anything or touching the windows of the server; it returns the lines
+//the guard of the stream reroutes and what every location does with the rest
+func Preview(stream config.Stream, lines []string, params url.Values, client string) ([]string, []LocationPreview) {
+    received := time.Now()
+    unit := precision(params.Get("precision"))
+    fields := logger.Fields{"stream":stream.Listen,"client":client}
+
+    m := &Write{Listen: stream.Listen, Locations: stream.Locations}
+    lines, rerouted := guard(stream.Timestamp_guard, lines, unit, received, stream.Listen, "", m.redacts(), fields)
+
+    b := &batch{query: params.Encode(), unit: unit, received: received, fields: fields}
+
+    var previews []LocationPreview
+    for _, locat := range stream.Locations {
+        preview := LocationPreview{Location: locat}
+
+        llines, lrerouted := guard(locat.Timestamp_guard, lines, unit, received, stream.Listen, locat.ID(), len(locat.Redact) > 0, fields)
+        preview.Rerouted = lrerouted
+
+        nlines := Transform(locat, llines, client)
+        preview.Sent = nlines
+
+        if locat.Aggregate != nil {
+            a := &aggregator{locat: locat, windows: make(map[string]*window)}
+            a.add(nlines, b)
+
+            windows := make([]*window, 0, len(a.windows))
+            for _, w := range a.windows {
+                windows = append(windows, w)
+            }
+            sort.Slice(windows, func(i, j int) bool { return windows[i].start.Before(windows[j].start) })
+            for _, w := range windows {
+                preview.Aggregated = append(preview.Aggregated, w.lines(locat.Aggregate)...)
+            }
+
+            if !locat.Aggregate.Pass_through {
+                preview.Sent = nil
+            }
+        }
+
+        previews = append(previews, preview)
+    }
+
+    return rerouted, previews
+}
@@ -0,0 +1,150 @@
+package streams
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "net"
+    "regexp"
+    "strings"
+    "github.com/ltkh/relay-server/internal/config"
+)
+
+var (
+    stringEscaper   = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+    stringUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`)
+)
+
+//rule is a redact rule ready to apply
+type rule struct {
+    conf         *config.Redact
+    tags         map[string]bool
+    fields       map[string]bool
+    pattern      *regexp.Regexp
+}
+
+//Redact applies the redact rules of a location to the tag values and string field values of the lines
+func Redact(locat config.Location, lines []string) []string {
+    if len(locat.Redact) == 0 {
+        return lines
+    }
+
+    rules := make([]rule, len(locat.Redact))
+    for i := range locat.Redact {
+        conf := &locat.Redact[i]
+        rules[i] = rule{conf: conf, tags: make(map[string]bool), fields: make(map[string]bool)}
+        for _, key := range conf.Tags {
+            rules[i].tags[key] = true
+        }
+        for _, key := range conf.Fields {
+            rules[i].fields[key] = true
+        }
+        rules[i].pattern = conf.Regexp()
+    }
+
+    nlines := make([]string, len(lines))
+    for i, line := range lines {
+        nlines[i] = line
+
+        end := seriesEnd(line)
+        if end <= 0 || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        name, pairs := splitTags(line[:end])
+        for n, pair := range pairs {
+            key := tagKey(pair)
+            if len(key) == len(pair) {
+                continue
+            }
+            value := tagUnescaper.Replace(pair[len(key)+1:])
+            redacted := value
+            for _, r := range rules {
+                redacted = r.apply(r.tags[tagUnescaper.Replace(key)], redacted)
+            }
+            if redacted != value {
+                pairs[n] = key + "=" + tagEscaper.Replace(redacted)
+            }
+        }
+
+        fields, rest := splitFields(line[end+1:])
+        for n, pair := range fields {
+            key := tagKey(pair)
+            if len(key) + 1 >= len(pair) || pair[len(key)+1] != '"' || !strings.HasSuffix(pair, `"`) {
+                continue
+            }
+            value := stringUnescaper.Replace(pair[len(key)+2:len(pair)-1])
+            redacted := value
+            for _, r := range rules {
+                redacted = r.apply(r.fields[tagUnescaper.Replace(key)], redacted)
+            }
+            if redacted != value {
+                fields[n] = key + `="` + stringEscaper.Replace(redacted) + `"`
+            }
+        }
+
+        nlines[i] = strings.Join(append([]string{name}, pairs...), ",") + " " + strings.Join(fields, ",") + rest
+    }
+
+    return nlines
+}
+
+//splitFields splits the field set at the start of s at the commas outside of string values,
+//it returns the rest of s after the field set as well
+func splitFields(s string) ([]string, string) {
+    var parts []string
+    start, quoted := 0, false
+    for i := 0; i < len(s); i++ {
+        switch c := s[i]; {
+        case c == '\\':
+            i++
+        case c == '"':
+            quoted = !quoted
+        case c == ',' && !quoted:
+            parts = append(parts, s[start:i])
+            start = i + 1
+        case c == ' ' && !quoted:
+            return append(parts, s[start:i]), s[i:]
+        }
+    }
+    return append(parts, s[start:]), ""
+}
+
+//apply redacts the whole value when all is set, else the parts matching the pattern of the rule
+func (r rule) apply(all bool, value string) string {
+    if all {
+        return r.replace(value)
+    }
+    if r.pattern != nil {
+        return r.pattern.ReplaceAllStringFunc(value, r.replace)
+    }
+    return value
+}
+
+//replace returns the redacted form of a value
+func (r rule) replace(value string) string {
+    switch r.conf.Method {
+    case "hmac":
+        mac := hmac.New(sha256.New, []byte(r.conf.Key))
+        mac.Write([]byte(value))
+        sum := hex.EncodeToString(mac.Sum(nil))
+        if r.conf.Length > 0 && r.conf.Length < len(sum) {
+            sum = sum[:r.conf.Length]
+        }
+        return sum
+    case "truncate":
+        if ip := net.ParseIP(value); ip != nil {
+            if ip4 := ip.To4(); ip4 != nil {
+                return ip4.Mask(net.CIDRMask(r.conf.Prefix_v4, 32)).String()
+            }
+            return ip.Mask(net.CIDRMask(r.conf.Prefix_v6, 128)).String()
+        }
+        if runes := []rune(value); r.conf.Length > 0 {
+            if r.conf.Length < len(runes) {
+                return string(runes[:r.conf.Length])
+            }
+            return value
+        }
+    }
+    return r.conf.Mask
+}
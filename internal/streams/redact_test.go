@@ -0,0 +1,34 @@
+package streams
+
+import (
+    "strings"
+    "testing"
+    "github.com/ltkh/relay-server/internal/config"
+)
+
+func TestRedact(t *testing.T) {
+    locat := config.Location{Redact: []config.Redact{
+        {Tags: []string{"user"}, Method: "hmac", Key: "secret", Length: 8},
+        {Tags: []string{"client_ip"}, Method: "truncate", Prefix_v4: 24, Prefix_v6: 48},
+        {Pattern: `[a-z]+@[a-z]+\.com`, Method: "mask", Mask: "redacted"},
+    }}
+    for i := range locat.Redact {
+        if err := locat.Redact[i].Compile(); err != nil {
+            t.Fatal(err)
+        }
+    }
+    got := Redact(locat, []string{`login,user=bob,client_ip=10.1.2.3 msg="mail from bob@example.com",n=1i 1`})[0]
+
+    if strings.Contains(got, "user=bob") || !strings.Contains(got, ",client_ip=10.1.2.0 ") {
+        t.Errorf("tags not redacted: %q", got)
+    }
+    if !strings.Contains(got, `msg="mail from redacted",n=1i 1`) {
+        t.Errorf("field not redacted: %q", got)
+    }
+
+    //hmac keeps equal values comparable
+    again := Redact(locat, []string{`login,user=bob value=1`})[0]
+    if user := strings.Split(strings.Split(got, ",")[1], "=")[1]; !strings.Contains(again, "user=" + user) || len(user) != 8 {
+        t.Errorf("hmac of bob differs: %q and %q", got, again)
+    }
+}
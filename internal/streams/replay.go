@@ -0,0 +1,253 @@
+package streams
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+    "github.com/ltkh/relay-server/internal/backend"
+    "github.com/ltkh/relay-server/internal/cache"
+    "github.com/ltkh/relay-server/internal/config"
+    "github.com/ltkh/relay-server/internal/logger"
+    "github.com/ltkh/relay-server/internal/monitor"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+    //replaying holds the locations whose cache is being resent
+    replaying sync.Map
+    //liveFailed holds the time live traffic of a location last failed to be delivered
+    liveFailed sync.Map
+    //replayed holds the cached records sent out after one before them failed, they are committed
+    //without being sent again once the replay gets past the failed one
+    replayed sync.Map
+)
+
+func deliveredKey(id string, pos cache.Position) string {
+    return fmt.Sprintf("%s/%d/%d", id, pos.Segment, pos.Offset)
+}
+
+//Replayer resends cached batches of each location once its backends answer again,
+//without more concurrency or bandwidth than the recovering backends are given
+type Replayer struct {
+    Cache        *cache.Cache
+    Locations    map[string]config.Location
+    Timeout      time.Duration
+    DelayTime    time.Duration
+    Repeat       int
+    Retry        *config.Retry
+    Batch        int
+    Concurrency  int
+    Rate         int64
+    Probe        string
+    Pause        time.Duration
+}
+
+//Replay resends up to Batch cached queries of a location in the order they were written,
+//stopping at the first one that still cannot be delivered
+func (r *Replayer) Replay(wal *cache.WAL) {
+    id := wal.ID()
+    fields := logger.Fields{"location":id}
+    if _, busy := replaying.LoadOrStore(id, true); busy {
+        return
+    }
+    defer replaying.Delete(id)
+
+    if !begin(1) {
+        return
+    }
+    defer end()
+
+    if last, ok := liveFailed.Load(id); ok && time.Since(last.(time.Time)) < r.Pause * time.Second {
+        return
+    }
+    if Paused(id) {
+        return
+    }
+
+    data, _, err := wal.Read(wal.Position())
+    if err == io.EOF {
+        return
+    }
+    if err != nil {
+        logger.With(fields).Errorf("reading cache: %v", err)
+        return
+    }
+
+    locat, known := r.Locations[id]
+    if !known {
+        //the location is no longer configured, its urls are known from the cached queries
+        if entry, err := cache.Decode(data); err == nil {
+            var query *Query
+            if err := json.Unmarshal(entry.Data, &query); err == nil {
+                locat.Urls = query.Urls
+            }
+        }
+    }
+    policy, timeout := sendPolicy(locat, r.Retry, r.Repeat, r.Timeout, r.DelayTime)
+
+    if err := r.probe(locat.Urls, timeout); err != nil {
+        logger.With(fields).Infof("postponing cache replay: %v", err)
+        return
+    }
+
+    concurrency := r.Concurrency
+    if concurrency <= 0 {
+        concurrency = 1
+    }
+    limit := &rateLimit{rate: r.Rate, start: time.Now()}
+
+    for sent := 0; sent < r.Batch && !stopped(); {
+        if last, ok := liveFailed.Load(id); ok && time.Since(last.(time.Time)) < r.Pause * time.Second {
+            logger.With(fields).Infof("pausing cache replay: live traffic is failing")
+            return
+        }
+
+        //reading the next records in order, each one is committed only once all before it were delivered
+        type item struct {
+            entry  *cache.Entry
+            pos    cache.Position
+            next   cache.Position
+            done   bool
+            err    error
+            points int
+            result string
+        }
+        var items []*item
+        pos := wal.Position()
+        for len(items) < concurrency && sent+len(items) < r.Batch {
+            data, next, err := wal.Read(pos)
+            if err == io.EOF {
+                break
+            }
+            if err != nil {
+                logger.With(fields).Errorf("reading cache: %v", err)
+                break
+            }
+            entry, err := cache.Decode(data)
+            if err != nil {
+                logger.With(fields).Errorf("reading cache entry: %v", err)
+            }
+            _, done := replayed.Load(deliveredKey(id, pos))
+            items = append(items, &item{entry: entry, pos: pos, next: next, done: done})
+            pos = next
+        }
+        if len(items) == 0 {
+            return
+        }
+
+        var wg sync.WaitGroup
+        for _, it := range items {
+            if it.entry == nil || it.done {
+                continue
+            }
+            var query *Query
+            if err := json.Unmarshal(it.entry.Data, &query); err != nil {
+                logger.With(fields).Errorf("reading cache entry: %v", err)
+                continue
+            }
+            query.Fields = logger.Fields{"stream":it.entry.Stream,"location":id}
+            limit.wait(len(query.Body))
+            it.points, it.result = CountPoints(strings.Split(string(query.Body), "\n")), "replayed"
+            wg.Add(1)
+            go func(it *item, query *Query) {
+                defer wg.Done()
+                if err := Sender(query, policy, timeout, nil); err != nil {
+                    //a batch rejected by the backend will not be accepted by replaying it again
+                    serr, ok := err.(*SendError)
+                    if !ok || !serr.Rejected {
+                        it.err = err
+                    } else {
+                        it.result = "rejected"
+                        if err := rejected(r.Cache.DeadLetter(), query, id, serr); err != nil {
+                            logger.With(query.Fields).Errorf("writing dead-letter: %v", err)
+                        }
+                    }
+                }
+            }(it, query)
+        }
+        wg.Wait()
+
+        for i, it := range items {
+            if it.err != nil {
+                for _, later := range items[i+1:] {
+                    if later.err == nil && later.entry != nil {
+                        replayed.Store(deliveredKey(id, later.pos), true)
+                    }
+                }
+                if stopped() {
+                    return
+                }
+                if _, err := r.Cache.Failed(wal, it.entry, it.next, it.err.Error()); err != nil {
+                    logger.With(fields).Errorf("recording cache replay failure: %v", err)
+                }
+                return
+            }
+            if err := wal.Commit(it.next); err != nil {
+                logger.With(fields).Errorf("committing cache offset: %v", err)
+                return
+            }
+            replayed.Delete(deliveredKey(id, it.pos))
+            if it.result != "" {
+                monitor.Points.With(prometheus.Labels{"location":id,"result":it.result}).Add(float64(it.points))
+            }
+            sent++
+        }
+    }
+}
+
+//probe checks that at least one backend of the location answers its health endpoint
+func (r *Replayer) probe(urls []string, timeout time.Duration) error {
+    if r.Probe == "" {
+        return nil
+    }
+
+    var last error
+    for _, u := range urls {
+        if last = probe(u, r.Probe, timeout); last == nil {
+            return nil
+        }
+    }
+    if last == nil {
+        last = fmt.Errorf("no backend urls")
+    }
+
+    return last
+}
+
+//probe requests path on the host of a backend write url
+func probe(rawurl string, path string, timeout time.Duration) error {
+    u, err := url.Parse(rawurl)
+    if err != nil {
+        return err
+    }
+    u.Path, u.RawQuery = path, ""
+
+    body, code, _, _ := request("GET", u.String(), "", nil, "", timeout, backend.Get(rawurl).Transport())
+    if code >= 300 {
+        return &SendError{Url: u.String(), Code: code, Body: string(body)}
+    }
+
+    return nil
+}
+
+//rateLimit spaces out sends so that no more than rate bytes per second go out on average
+type rateLimit struct {
+    rate         int64
+    start        time.Time
+    bytes        int64
+}
+
+func (l *rateLimit) wait(n int) {
+    if l.rate <= 0 {
+        return
+    }
+    l.bytes += int64(n)
+    due := l.start.Add(time.Duration(float64(l.bytes) / float64(l.rate) * float64(time.Second)))
+    if d := time.Until(due); d > 0 {
+        time.Sleep(d)
+    }
+}
@@ -0,0 +1,129 @@
+package streams
+
+import (
+    "math"
+    "math/rand"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+    "github.com/ltkh/relay-server/internal/config"
+)
+
+var (
+    jitterMu     sync.Mutex
+    jitter       = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+//RetryPolicy decides which responses are worth another round over the urls of a location and how long to wait before it
+type RetryPolicy struct {
+    Retries      int
+    Initial      time.Duration
+    Max          time.Duration
+    Multiplier   float64
+    MaxElapsed   time.Duration
+    Statuses     []string
+    Jitter       bool
+}
+
+//NoRetry tries every url once
+var NoRetry = &RetryPolicy{Statuses: []string{"5xx"}}
+
+//sendPolicy returns the retry policy and timeout of a location, falling back to the write defaults;
+//without a retry section the fixed repeat and delay_time settings apply
+func sendPolicy(locat config.Location, retry *config.Retry, repeat int, timeout time.Duration, delay time.Duration) (*RetryPolicy, time.Duration) {
+    if locat.Timeout != 0 {
+        timeout = locat.Timeout
+    }
+    if locat.Retry != nil {
+        retry = locat.Retry
+    }
+
+    if retry == nil {
+        if locat.Repeat != 0 {
+            repeat = locat.Repeat
+        }
+        if locat.Delay_time != 0 {
+            delay = locat.Delay_time
+        }
+        return &RetryPolicy{
+            Retries:    repeat,
+            Initial:    delay * time.Second,
+            Max:        delay * time.Second,
+            Multiplier: 1,
+            Statuses:   []string{"5xx"},
+        }, timeout
+    }
+
+    return &RetryPolicy{
+        Retries:    retry.Max_retries,
+        Initial:    retry.Initial_interval * time.Second,
+        Max:        retry.Max_interval * time.Second,
+        Multiplier: retry.Multiplier,
+        MaxElapsed: retry.Max_elapsed * time.Second,
+        Statuses:   retry.Statuses,
+        Jitter:     true,
+    }, timeout
+}
+
+//once returns a copy of the policy that tries every url only once
+func (p *RetryPolicy) once() *RetryPolicy {
+    policy := *p
+    policy.Retries, policy.MaxElapsed = 0, 0
+    return &policy
+}
+
+//Retryable reports whether a response status, or 503 for a transport error, is worth retrying
+func (p *RetryPolicy) Retryable(code int) bool {
+    for _, status := range p.Statuses {
+        if status == strconv.Itoa(code) {
+            return true
+        }
+        if len(status) == 3 && status[1:] == "xx" && status[0] == byte('0'+code/100) {
+            return true
+        }
+    }
+    return false
+}
+
+//retry reports whether another round may follow round attempt (starting at 0); with only
+//a maximum elapsed time set, rounds go on until it is reached
+func (p *RetryPolicy) retry(attempt int) bool {
+    if p.Retries > 0 {
+        return attempt < p.Retries
+    }
+    return p.MaxElapsed > 0
+}
+
+//Backoff returns the wait before retry round attempt (starting at 0): exponential up to the maximum,
+//spread over the whole interval when jitter is on
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+    delay := float64(p.Initial) * math.Pow(p.Multiplier, float64(attempt))
+    if p.Max > 0 && delay > float64(p.Max) {
+        delay = float64(p.Max)
+    }
+    if !p.Jitter || delay <= 0 {
+        return time.Duration(delay)
+    }
+
+    jitterMu.Lock()
+    defer jitterMu.Unlock()
+    return time.Duration(jitter.Int63n(int64(delay) + 1))
+}
+
+//retryAfter reads the Retry-After header in either of its forms, seconds or an http date
+func retryAfter(header http.Header) time.Duration {
+    value := header.Get("Retry-After")
+    if value == "" {
+        return 0
+    }
+    if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+        return time.Duration(seconds) * time.Second
+    }
+    if date, err := http.ParseTime(value); err == nil {
+        if d := time.Until(date); d > 0 {
+            return d
+        }
+    }
+    return 0
+}
@@ -0,0 +1,75 @@
+package streams
+
+import (
+    "net/http"
+    "testing"
+    "time"
+    "github.com/ltkh/relay-server/internal/config"
+)
+
+func TestRetryable(t *testing.T) {
+    policy := &RetryPolicy{Statuses: []string{"408", "429", "5xx"}}
+    for code, want := range map[int]bool{200: false, 400: false, 408: true, 429: true, 500: true, 503: true} {
+        if got := policy.Retryable(code); got != want {
+            t.Errorf("Retryable(%d) = %v, want %v", code, got, want)
+        }
+    }
+}
+
+func TestBackoff(t *testing.T) {
+    policy := &RetryPolicy{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2}
+    for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+        if got := policy.Backoff(attempt); got != want {
+            t.Errorf("Backoff(%d) = %v, want %v", attempt, got, want)
+        }
+    }
+
+    policy.Jitter = true
+    for attempt := 0; attempt < 10; attempt++ {
+        if got := policy.Backoff(attempt); got < 0 || got > policy.Max {
+            t.Errorf("Backoff(%d) with jitter = %v, out of [0, %v]", attempt, got, policy.Max)
+        }
+    }
+}
+
+func TestRetryRounds(t *testing.T) {
+    policy := &RetryPolicy{Retries: 2}
+    if !policy.retry(0) || !policy.retry(1) || policy.retry(2) {
+        t.Errorf("retries 2: rounds after 0, 1 and 2 = %v %v %v", policy.retry(0), policy.retry(1), policy.retry(2))
+    }
+
+    //only a maximum elapsed time, the rounds go on until it is reached
+    policy = &RetryPolicy{MaxElapsed: time.Minute}
+    if !policy.retry(100) {
+        t.Errorf("max elapsed: no round after 100")
+    }
+    if once := policy.once(); once.retry(0) || policy.MaxElapsed != time.Minute {
+        t.Errorf("once() retries or changed the policy")
+    }
+}
+
+func TestSendPolicy(t *testing.T) {
+    //without a retry section the fixed repeat and delay_time of the location apply
+    policy, timeout := sendPolicy(config.Location{Repeat: 3, Delay_time: 2, Timeout: 5}, nil, 1, 20, 10)
+    if policy.Retries != 3 || policy.Initial != 2 * time.Second || policy.Backoff(2) != 2 * time.Second || timeout != 5 {
+        t.Errorf("fixed policy = %+v, timeout %v", policy, timeout)
+    }
+
+    retry := &config.Retry{Max_retries: 4, Initial_interval: 1, Max_interval: 30, Multiplier: 2, Statuses: []string{"5xx"}}
+    policy, timeout = sendPolicy(config.Location{}, retry, 1, 20, 10)
+    if policy.Retries != 4 || policy.Max != 30 * time.Second || !policy.Jitter || timeout != 20 {
+        t.Errorf("retry policy = %+v, timeout %v", policy, timeout)
+    }
+}
+
+func TestRetryAfter(t *testing.T) {
+    header := http.Header{}
+    header.Set("Retry-After", "7")
+    if got := retryAfter(header); got != 7 * time.Second {
+        t.Errorf("retryAfter(7) = %v", got)
+    }
+    header.Set("Retry-After", "soon")
+    if got := retryAfter(header); got != 0 {
+        t.Errorf("retryAfter(soon) = %v", got)
+    }
+}
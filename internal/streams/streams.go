@@ -2,45 +2,150 @@ package streams
 
 import (
     "net/http"
-    "log"
+    "fmt"
     "time"
     "regexp"
     "io/ioutil"
     "strings"
-    "encoding/json"
-    "crypto/md5"
+    "strconv"
+    "net"
+    "crypto/rand"
     "encoding/hex"
+    "encoding/json"
+    "encoding/base64"
     "github.com/influxdata/line-protocol"
+    "github.com/ltkh/relay-server/internal/backend"
+    "github.com/ltkh/relay-server/internal/cache"
     "github.com/ltkh/relay-server/internal/monitor"
     "github.com/ltkh/relay-server/internal/config"
+    "github.com/ltkh/relay-server/internal/logger"
     "github.com/prometheus/client_golang/prometheus"
 )
 
 type Write struct {
     Listen       string
+    Validation   string
     Locations    []config.Location
     Timeout      time.Duration
     DelayTime    time.Duration
     Repeat       int
-    CacheDir     string
+    Retry        *config.Retry
+    Cache        *cache.Cache
+    DeadLetter   *cache.DeadLetter
+    Ack          string
+    AckTimeout   time.Duration
+    Access       *logger.Logger
+    Freshness    *config.Freshness
+    TimestampGuard *config.Timestamp_guard
+    Locate       func(id string) (config.Location, bool)
 }
 
 type Query struct {
+    Stream       string
     Urls         []string
     Auth         string
     Query        string
     Body         []byte
+    Fields       logger.Fields `json:"-"`
+}
+
+type LineError struct {
+    Line         int         `json:"line"`
+    Text         string      `json:"text"`
+    Error        string      `json:"error"`
+}
+
+type Validation struct {
+    Lines        int         `json:"lines"`
+    Valid        int         `json:"valid"`
+    Invalid      int         `json:"invalid"`
+    Errors       []LineError `json:"errors"`
 }
 
 func readUserIP(r *http.Request) string {
     IPAddress := r.Header.Get("X-Real-Ip")
     if IPAddress == "" {
-        IPAddress = r.Header.Get("X-Forwarded-For")
+        IPAddress = strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-For"), ",")[0])
+    }
+    if IPAddress == "" {
+        IPAddress, _, _ = net.SplitHostPort(r.RemoteAddr)
     }
     return IPAddress
 }
 
+//maxErrorHeader is the longest X-Influxdb-Error header written
+const maxErrorHeader = 1024
+
+var (
+    //requestIDRegexp matches the client request ids that are safe to log and return
+    requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+)
+
+//requestID returns the id the client sent in X-Request-Id, or a new one when there is none or it
+//is longer than 64 characters or has others than letters, digits, '.', '_', ':' and '-'
+func requestID(r *http.Request) string {
+    if id := r.Header.Get("X-Request-Id"); requestIDRegexp.MatchString(id) {
+        return id
+    }
+    buf := make([]byte, 8)
+    rand.Read(buf)
+    return hex.EncodeToString(buf)
+}
+
+//exchange is what the access log records about a request besides the request itself
+type exchange struct {
+    http.ResponseWriter
+    id           string
+    client       string
+    status       int
+    bytes        int
+    points       int
+}
+
+func (e *exchange) WriteHeader(code int) {
+    e.status = code
+    e.ResponseWriter.WriteHeader(code)
+}
+
+//CountPoints returns the number of lines of a batch that hold a point
+func CountPoints(lines []string) int {
+    cnt := 0
+    for _, line := range lines {
+        if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+            cnt++
+        }
+    }
+    return cnt
+}
+
 func (m *Write) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    start := time.Now()
+
+    ex := &exchange{ResponseWriter: w, id: requestID(r), client: readUserIP(r), status: http.StatusOK}
+    w.Header().Set("X-Request-Id", ex.id)
+
+    m.serve(ex, r)
+
+    if m.Access != nil {
+        m.Access.Log(logger.Info, "access", logger.Fields{
+            "stream":     m.Listen,
+            "request_id": ex.id,
+            "client":     ex.client,
+            "method":     r.Method,
+            "path":       r.URL.Path,
+            "db":         r.URL.Query().Get("db"),
+            "bytes":      ex.bytes,
+            "points":     ex.points,
+            "status":     ex.status,
+            "duration":   time.Since(start).Seconds(),
+        })
+    }
+}
+
+func (m *Write) serve(w *exchange, r *http.Request) {
+    received := time.Now()
+
+    fields := logger.Fields{"stream":m.Listen,"client":w.client,"request_id":w.id}
 
     if r.URL.Path == "/ping" {
         w.WriteHeader(204)
@@ -52,94 +157,493 @@ func (m *Write) ServeHTTP(w http.ResponseWriter, r *http.Request) {
         //reading request body
         body, err := ioutil.ReadAll(r.Body)
         if err != nil {
-            log.Printf("[error] %v - %s", err, r.URL.Path)
+            logger.With(fields).Errorf("reading request body: %v", err)
         }
         defer r.Body.Close()
+        w.bytes = len(body)
 
         lines := strings.Split(string(body), "\n")
 
-        handler := protocol.NewMetricHandler()
-        parser := protocol.NewParser(handler)
-
-        rhost := readUserIP(r)
+        client := monitor.Client(w.client)
 
         //parsing request body
-        for _, line := range lines {
-            if line != "" {
-                _, err := parser.Parse([]byte(line))
-                if err != nil {
-                    monitor.ErrCounter.With(prometheus.Labels{"rhost":rhost,"uri":r.RequestURI}).Inc()
-                    log.Printf("[error] %v (%s)", err, rhost)
-                }
-                monitor.PntCounter.With(prometheus.Labels{"rhost":rhost,"uri":r.RequestURI}).Inc()
+        valid, errors := ParseLines(lines)
+        redacted := m.redacts()
+        for _, lerr := range errors {
+            monitor.ErrCounter.With(prometheus.Labels{"rhost":client,"listen":m.Listen}).Inc()
+            if redacted {
+                logger.With(fields).Errorf("parsing line %d", lerr.Line)
+            } else {
+                logger.With(fields).Errorf("parsing line %d: %s", lerr.Line, lerr.Error)
             }
         }
+        w.points = len(valid)
+        freshness(m.Listen, m.Freshness, valid, precision(r.URL.Query().Get("precision")), received)
+        monitor.PntCounter.With(prometheus.Labels{"rhost":client,"listen":m.Listen}).Add(float64(len(valid)+len(errors)))
 
         monitor.ReqCounter.With(prometheus.Labels{"listen":m.Listen}).Inc()
 
-        for _, locat := range m.Locations {
+        switch m.Validation {
+        case "reject":
+            if len(errors) > 0 {
+                writePartial(w, errors)
+                return
+            }
+        case "drop_invalid":
+            lines = valid
+            //nothing is left to forward
+            if len(lines) == 0 {
+                if len(errors) > 0 {
+                    writePartial(w, errors)
+                } else {
+                    w.WriteHeader(204)
+                }
+                return
+            }
+        }
 
-            go func(locat config.Location, lines []string){
+        auth := r.Header.Get("Authorization")
+        params := r.URL.Query()
 
-                nlines := make([]string, len(lines))
-                copy(nlines, lines)
+        ack := m.Ack
+        if consistency := params.Get("consistency"); consistency != "" {
+            if ack, err = ConsistencyAck(consistency); err != nil {
+                writeError(w, http.StatusBadRequest, err.Error())
+                return
+            }
+        }
 
-                for _, rexp := range locat.Regexp {
-                    re := regexp.MustCompile(rexp.Match)
-                    for k, line := range nlines {
-                        nlines[k] = re.ReplaceAllString(line, rexp.Replace)
-                    }
-                }
+        if !begin(len(m.Locations)) {
+            writeError(w, http.StatusServiceUnavailable, "server is shutting down")
+            return
+        }
 
-                query := &Query{
-                    Urls:   locat.Urls,
-                    Auth:   r.Header.Get("Authorization"),
-                    Query:  r.URL.Query().Encode(),
-                    Body:   []byte(strings.Join(nlines, "\n")),
-                }
+        b := &batch{
+            auth:     auth,
+            query:    params.Encode(),
+            unit:     precision(params.Get("precision")),
+            received: received,
+            fields:   fields,
+            ack:      ack,
+        }
 
-                //log.Printf("[debug] %v %v %v", locat.Urls, locat.Regexp, strings.Join(nlines, "\n"))
+        lines, rerouted := guard(m.TimestampGuard, lines, b.unit, received, m.Listen, "", m.redacts(), fields)
+        m.quarantine(m.TimestampGuard, rerouted, b)
 
-                go Sender(query, m.Repeat, m.Timeout, m.DelayTime, locat.Cache, m.CacheDir)
+        results := make(chan error, len(m.Locations))
 
-            }(locat, lines)
+        //locations only sending rollups later are left out of the ack, their windows are not sent yet
+        acked := 0
+        for _, locat := range m.Locations {
+            counted := locat.Aggregate == nil || locat.Aggregate.Pass_through
+            if counted {
+                acked++
+            }
+
+            go func(locat config.Location, lines []string, counted bool){
+                defer end()
+                err := m.send(locat, lines, b, true)
+                if counted {
+                    results <- err
+                }
+            }(locat, lines, counted)
+
+        }
 
+        if code, err := waitAck(ack, acked, results, m.AckTimeout); err != nil {
+            logger.With(fields).Errorf("%v", err)
+            writeError(w, code, err.Error())
+            return
+        }
+
+        if m.Validation == "drop_invalid" && len(errors) > 0 {
+            writePartial(w, errors)
+            return
         }
 
         w.WriteHeader(204)
         return
     }
 
+    if r.URL.Path == "/validate" {
+
+        //reading request body
+        body, err := ioutil.ReadAll(r.Body)
+        if err != nil {
+            logger.With(fields).Errorf("reading request body: %v", err)
+        }
+        defer r.Body.Close()
+        w.bytes = len(body)
+
+        valid, errors := ParseLines(strings.Split(string(body), "\n"))
+
+        result := Validation{
+            Lines:   len(valid) + len(errors),
+            Valid:   len(valid),
+            Invalid: len(errors),
+            Errors:  errors,
+        }
+        if result.Errors == nil {
+            result.Errors = []LineError{}
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(200)
+        json.NewEncoder(w).Encode(result)
+        return
+    }
+
     w.WriteHeader(404)
 }
 
-func Sender(query *Query, repeat int, timeout time.Duration, delay time.Duration, cache bool, cacheDir string){
-    for i := 0; i <= repeat; i++ {
+//batch is what the locations of a write share
+type batch struct {
+    auth         string
+    query        string
+    unit         time.Duration
+    received     time.Time
+    fields       logger.Fields
+    ack          string
+}
+
+//send delivers the lines of a write to a location, applying its timestamp guard first when guarded is set
+func (m *Write) send(locat config.Location, lines []string, b *batch, guarded bool) error {
+    lfields := logger.Fields{"location":locat.ID()}
+    for key, value := range b.fields {
+        lfields[key] = value
+    }
+
+    if guarded {
+        var rerouted []string
+        lines, rerouted = guard(locat.Timestamp_guard, lines, b.unit, b.received, m.Listen, locat.ID(), len(locat.Redact) > 0, lfields)
+        m.quarantine(locat.Timestamp_guard, rerouted, b)
+    }
+
+    nlines := Transform(locat, lines, fmt.Sprint(b.fields["client"]))
+
+    if locat.Aggregate != nil {
+        if nlines = aggregate(m, locat, nlines, b); len(nlines) == 0 {
+            return nil
+        }
+    }
+
+    return m.deliver(locat, nlines, b, lfields)
+}
+
+//deliver sends lines, already transformed, to a location
+func (m *Write) deliver(locat config.Location, nlines []string, b *batch, lfields logger.Fields) error {
+    query := &Query{
+        Stream: m.Listen,
+        Urls:   locat.Urls,
+        Auth:   locationAuth(locat, b.auth),
+        Query:  b.query,
+        Body:   []byte(strings.Join(nlines, "\n")),
+        Fields: lfields,
+    }
+
+    if logger.Default().Enabled(logger.Debug) {
+        if len(locat.Redact) > 0 {
+            logger.With(lfields).Debugf("routing batch: %v %d lines", locat.Urls, len(nlines))
+        } else {
+            logger.With(lfields).Debugf("routing batch: %v %s", locat.Urls, query.Body)
+        }
+    }
+
+    //archives have no urls to replay a cache to, their batches are never cached
+    var wal *cache.WAL
+    if locat.Cache && m.Cache != nil && locat.Archive == nil {
+        var err error
+        if wal, err = m.Cache.Location(locat.ID()); err != nil {
+            logger.With(lfields).Errorf("opening cache: %v", err)
+        }
+    }
+
+    if Paused(locat.ID()) {
+        err := hold(query, wal)
+        delivered(locat.ID(), CountPoints(nlines), err)
+        return err
+    }
+
+    if locat.Archive != nil {
+        err := archiveLines(locat, b.query, nlines, b.unit, b.received)
+        delivered(locat.ID(), CountPoints(nlines), err)
+        if err != nil {
+            logger.With(lfields).Errorf("writing archive: %v", err)
+        }
+        return err
+    }
+
+    policy, timeout := sendPolicy(locat, m.Retry, m.Repeat, m.Timeout, m.DelayTime)
+    if b.ack == "durable" && wal != nil {
+        //the batch is persisted after the first round over the urls, the ack does not wait
+        //for the retries, the cache replay takes them over
+        policy = policy.once()
+    }
+
+    err := Sender(query, policy, timeout, wal)
+    delivered(locat.ID(), CountPoints(nlines), err)
+    if serr, ok := err.(*SendError); ok && !serr.Rejected {
+        liveFailed.Store(locat.ID(), time.Now())
+    }
+    if serr, ok := err.(*SendError); ok && serr.Rejected {
+        if err := rejected(m.DeadLetter, query, locat.ID(), serr); err != nil {
+            logger.With(lfields).Errorf("writing dead-letter: %v", err)
+        }
+    }
+    return err
+}
+
+//quarantine sends the points a timestamp guard rerouted to its location, outside of the ack of the write
+func (m *Write) quarantine(g *config.Timestamp_guard, lines []string, b *batch) {
+    if len(lines) == 0 {
+        return
+    }
+
+    var locat config.Location
+    ok := m.Locate != nil
+    if ok {
+        locat, ok = m.Locate(g.Location)
+    }
+    if !ok || !begin(1) {
+        logger.With(b.fields).Errorf("timestamp guard: dropping %d points, location %q is not available", len(lines), g.Location)
+        return
+    }
+
+    //the quarantine is not part of the ack, it keeps every retry
+    qb := *b
+    qb.ack = ""
+
+    go func() {
+        defer end()
+        m.send(locat, lines, &qb, false)
+    }()
+}
+
+//delivered counts the points of a batch of a location by the outcome of its send
+func delivered(id string, points int, err error) {
+    result := "delivered"
+    if serr, ok := err.(*SendError); ok {
+        switch {
+        case serr.Cached:
+            result = "cached"
+        case serr.Rejected:
+            result = "rejected"
+        default:
+            result = "dropped"
+            monitor.DrpCounter.With(prometheus.Labels{"url":serr.Url}).Inc()
+        }
+    } else if err != nil {
+        result = "dropped"
+    }
+    monitor.Points.With(prometheus.Labels{"location":id,"result":result}).Add(float64(points))
+}
+
+//redacts reports whether a location of the stream redacts its points, their contents are not logged then
+func (m *Write) redacts() bool {
+    for _, locat := range m.Locations {
+        if len(locat.Redact) > 0 {
+            return true
+        }
+    }
+    return false
+}
+
+//locationAuth returns the credentials of the location when it has some, or else the ones of the client
+func locationAuth(locat config.Location, auth string) string {
+    if locat.Username == "" && locat.Password == "" {
+        return auth
+    }
+    return "Basic " + base64.StdEncoding.EncodeToString([]byte(locat.Username + ":" + locat.Password))
+}
+
+//Process applies the rewrites of a location to a copy of the lines
+func Process(locat config.Location, lines []string) []string {
+    nlines := make([]string, len(lines))
+    copy(nlines, lines)
+
+    //the expressions are compiled once when the config is loaded
+    for i := range locat.Regexp {
+        rexp := &locat.Regexp[i]
+        re := rexp.Regexp()
+        if re == nil {
+            continue
+        }
+        for k, line := range nlines {
+            nlines[k] = re.ReplaceAllString(line, rexp.Replace)
+        }
+    }
+
+    return nlines
+}
+
+//ParseLines returns the non-empty lines the parser accepts and a diagnostic for every other one
+func ParseLines(lines []string) ([]string, []LineError) {
+    var valid []string
+    var errors []LineError
+
+    parser := protocol.NewParser(protocol.NewMetricHandler())
+
+    for i, line := range lines {
+        if line == "" {
+            continue
+        }
+        if _, err := parser.Parse([]byte(line)); err != nil {
+            errors = append(errors, LineError{Line: i + 1, Text: line, Error: err.Error()})
+            continue
+        }
+        valid = append(valid, line)
+    }
+
+    return valid, errors
+}
+
+//partialWrite formats errors the way InfluxDB reports a partial write
+func partialWrite(errors []LineError) string {
+    failed := make([]string, len(errors))
+    for i, lerr := range errors {
+        failed[i] = fmt.Sprintf("unable to parse '%s' (line %d): %s", lerr.Text, lerr.Line, lerr.Error)
+    }
+    return fmt.Sprintf("partial write: %s dropped=%d", strings.Join(failed, "\n"), len(errors))
+}
+
+//partialHeader is the X-Influxdb-Error header of a partial write: the first error and the count,
+//the full text only goes into the body, so many bad lines can not make a header proxies reject
+func partialHeader(errors []LineError) string {
+    if len(errors) == 0 {
+        return "partial write: dropped=0"
+    }
+    lerr := errors[0]
+    return headerValue(fmt.Sprintf("partial write: unable to parse '%s' (line %d): %s dropped=%d", lerr.Text, lerr.Line, lerr.Error, len(errors)))
+}
+
+//headerValue cuts an error message to the length and the single line a header can hold
+func headerValue(msg string) string {
+    if i := strings.IndexByte(msg, '\n'); i >= 0 {
+        msg = msg[:i]
+    }
+    if len(msg) > maxErrorHeader {
+        msg = msg[:maxErrorHeader] + "..."
+    }
+    return msg
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+    writeErrorHeader(w, code, msg, headerValue(msg))
+}
+
+//writePartial answers a write some lines of which could not be parsed
+func writePartial(w http.ResponseWriter, errors []LineError) {
+    writeErrorHeader(w, http.StatusBadRequest, partialWrite(errors), partialHeader(errors))
+}
+
+func writeErrorHeader(w http.ResponseWriter, code int, msg string, header string) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Influxdb-Error", header)
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func Sender(query *Query, policy *RetryPolicy, timeout time.Duration, wal *cache.WAL) error {
+    serr := &SendError{}
+    start := time.Now()
+    attempts := 0
+    for i := 0; ; i++ {
+        attempts++
+        var wait time.Duration
+        final := false
         for _, url := range query.Urls {
-            _, code := request("POST", url, query.Query, query.Body, query.Auth, timeout)
-            if code < 500 { 
-                return
+            //backends with an open circuit breaker are skipped, the batch fails over to the next url
+            back := backend.Get(url)
+            if !back.Allow() {
+                if serr.Code == 0 {
+                    serr.Url, serr.Code, serr.Body = url, http.StatusServiceUnavailable, "circuit breaker open"
+                }
+                continue
+            }
+            back.Begin()
+            sent := time.Now()
+            body, code, after, err := request("POST", url, query.Query, query.Body, query.Auth, timeout, back.Transport())
+            back.End()
+            monitor.RequestDuration.With(prometheus.Labels{"url":url}).Observe(time.Since(sent).Seconds())
+            monitor.RequestBytes.With(prometheus.Labels{"url":url}).Add(float64(len(query.Body)))
+            monitor.ResponseBytes.With(prometheus.Labels{"url":url}).Add(float64(len(body)))
+            monitor.Responses.With(prometheus.Labels{"url":url,"code":strconv.Itoa(code)}).Inc()
+            if code < 300 {
+                back.Success()
+                return nil
+            }
+            serr.Url, serr.Code, serr.Body = url, code, strings.TrimSpace(string(body))
+            if err != nil {
+                logger.With(query.Fields).With(logger.Fields{"url":url}).Errorf("sending batch: %v", err)
             } else {
-                monitor.DrpCounter.With(prometheus.Labels{"url":url}).Inc()
+                logger.With(query.Fields).With(logger.Fields{"url":url,"status":code}).Warnf("sending batch: %s", serr.Body)
+            }
+            //the breaker hears of every answer, a half-open one would otherwise keep waiting for its probe
+            if code >= 500 {
+                back.Failure()
+            } else {
+                back.Success()
+            }
+            if stopped() {
+                final = true
+                break
+            }
+            if !policy.Retryable(code) {
+                if code >= 400 && code < 500 {
+                    //the backend refused the batch itself, other urls would do the same
+                    serr.Rejected = true
+                    return serr
+                }
+                final = true
+            }
+            //a retry-after of the backend is capped, so it can not hold a batch for longer than the policy allows
+            if limit := policy.Max; limit > 0 && after > limit {
+                after = limit
+            } else if limit <= 0 && after > timeout * time.Second {
+                after = timeout * time.Second
             }
+            if after > wait {
+                wait = after
+            }
+        }
+        if final || !policy.retry(i) || stopped() {
+            break
+        }
+        if backoff := policy.Backoff(i); backoff > wait {
+            wait = backoff
+        }
+        if policy.MaxElapsed > 0 && time.Since(start) + wait > policy.MaxElapsed {
+            break
+        }
+        select {
+        case <-time.After(wait):
+        case <-stopCtx.Done():
+        }
+        if stopped() {
+            break
         }
-        time.Sleep(delay * time.Second)
     }
-    if cache {
-        if err := cacheWrite(query, cacheDir); err != nil {
-            log.Printf("[error] %v", err)
+    if wal != nil {
+        if err := cacheWrite(query, wal, attempts, serr.Error()); err != nil {
+            logger.With(query.Fields).Errorf("writing cache: %v", err)
+        } else {
+            serr.Cached = true
         }
     }
+    return serr
 }
 
-func request(method string, url string, query string, rbody []byte, auth string, timeout time.Duration) ([]byte, int) {
+//request sends one http request, a transport error is returned with the status 503 and its text as the body
+func request(method string, url string, query string, rbody []byte, auth string, timeout time.Duration, transport http.RoundTripper) ([]byte, int, time.Duration, error) {
   
-    client := &http.Client{ Timeout: time.Duration(timeout * time.Second) }
+    client := &http.Client{
+        Timeout:   time.Duration(timeout * time.Second),
+        Transport: transport,
+    }
 
-    req, err := http.NewRequest(method, url, strings.NewReader(string(rbody)))
+    req, err := http.NewRequestWithContext(stopCtx, method, url, strings.NewReader(string(rbody)))
     if err != nil {
-        log.Printf("[error] %v %d", err, http.StatusServiceUnavailable)
-        return []byte(err.Error()), http.StatusServiceUnavailable
+        return []byte(err.Error()), http.StatusServiceUnavailable, 0, err
     }
 
     req.URL.RawQuery = query
@@ -150,36 +654,39 @@ func request(method string, url string, query string, rbody []byte, auth string,
 
     resp, err := client.Do(req)
     if err != nil {
-        log.Printf("[error] %v %d", err, http.StatusServiceUnavailable)
-        return []byte(err.Error()), http.StatusServiceUnavailable
+        return []byte(err.Error()), http.StatusServiceUnavailable, 0, err
     }
     defer resp.Body.Close() 
 
     //reading request body
     body, err := ioutil.ReadAll(resp.Body)
     if err != nil {
-        log.Printf("[error] %v %d", err, http.StatusServiceUnavailable)
-        return []byte(err.Error()), http.StatusServiceUnavailable
+        return []byte(err.Error()), http.StatusServiceUnavailable, 0, err
     }
   
-    return body, resp.StatusCode
+    return body, resp.StatusCode, retryAfter(resp.Header), nil
 
 }
 
-func cacheWrite(query *Query, dir string) error {
-    out, err := json.MarshalIndent(query, "", "")
+func cacheWrite(query *Query, wal *cache.WAL, attempts int, reason string) error {
+    data, err := json.Marshal(query)
     if err != nil {
         return err
     }
 
-    hasher := md5.New()
-    hasher.Write(out)
-
-    path := dir+"/"+hex.EncodeToString(hasher.Sum(nil))
+    entry := &cache.Entry{
+        Stream:   query.Stream,
+        Location: wal.ID(),
+        Failed:   time.Now(),
+        Attempts: attempts,
+        Error:    reason,
+        Data:     data,
+    }
 
-    if err := ioutil.WriteFile(path, out, 0644); err != nil {
+    out, err := entry.Encode()
+    if err != nil {
         return err
     }
 
-    return nil
+    return wal.Append(out)
 }
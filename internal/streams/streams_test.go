@@ -0,0 +1,25 @@
+package streams
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestWritePartial(t *testing.T) {
+    var errors []LineError
+    for i := 1; i <= 100; i++ {
+        errors = append(errors, LineError{Line: i, Text: strings.Repeat("x", 100), Error: "invalid field format"})
+    }
+
+    w := httptest.NewRecorder()
+    writePartial(w, errors)
+
+    header := w.Header().Get("X-Influxdb-Error")
+    if len(header) > maxErrorHeader + 3 || strings.Contains(header, "\n") || !strings.HasSuffix(header, "dropped=100") {
+        t.Errorf("header = %q", header)
+    }
+    if w.Code != 400 || strings.Count(w.Body.String(), "unable to parse") != 100 {
+        t.Errorf("status %d, body %q", w.Code, w.Body.String())
+    }
+}
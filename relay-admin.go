@@ -0,0 +1,277 @@
+package main
+
+import (
+    "crypto/subtle"
+    "log"
+    "net/http"
+    "strings"
+    "github.com/ltkh/relay-server/internal/backend"
+    "github.com/ltkh/relay-server/internal/cache"
+    "github.com/ltkh/relay-server/internal/streams"
+)
+
+//Admin serves the admin api on the monitoring port
+type Admin struct {
+    Token        string
+    Cache        *cache.Cache
+}
+
+type locationView struct {
+    ID           string       `json:"id"`
+    Name         string       `json:"name,omitempty"`
+    Urls         []string     `json:"urls"`
+    Cache        bool         `json:"cache"`
+    Paused       bool         `json:"paused"`
+    Backlog      *cache.Stats `json:"backlog,omitempty"`
+}
+
+type streamView struct {
+    Listen       string         `json:"listen"`
+    Validation   string         `json:"validation"`
+    Ack          string         `json:"ack"`
+    Locations    []locationView `json:"locations"`
+}
+
+type backendView struct {
+    backend.Status
+    Locations    []string     `json:"locations"`
+    Backlog      cache.Stats  `json:"backlog"`
+}
+
+//Handle registers a handler of the api, behind the admin token when there is one
+func (a *Admin) Handle(pattern string, handler http.Handler) {
+    http.Handle(pattern, a.protect(handler))
+}
+
+//Register registers the handlers of the admin api
+func (a *Admin) Register(reloader *Reloader) {
+    if a.Token == "" {
+        log.Print("[info] admin api is disabled, set monit.admin_token to use it")
+    }
+    a.Handle("/api/streams", http.HandlerFunc(a.streams))
+    a.Handle("/api/backends", http.HandlerFunc(a.backends))
+    a.Handle("/api/config", http.HandlerFunc(a.config))
+    a.Handle("/api/locations/", http.HandlerFunc(a.locations))
+    a.Handle("/api/sync", http.HandlerFunc(a.sync))
+    a.Handle("/api/replay", http.HandlerFunc(a.replay))
+    a.Handle("/api/replay/", http.HandlerFunc(a.replay))
+    a.Handle("/api/reload", reloader)
+}
+
+//protect accepts requests with the token as a bearer token or in X-Admin-Token; without
+//a token the api is not served at all
+func (a *Admin) protect(handler http.Handler) http.Handler {
+    if a.Token == "" {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            streams.WriteJSON(w, http.StatusForbidden, map[string]string{"error": "set monit.admin_token to use the admin api"})
+        })
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        token := r.Header.Get("X-Admin-Token")
+        if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+            token = strings.TrimPrefix(auth, "Bearer ")
+        }
+        if subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+            w.Header().Set("WWW-Authenticate", `Bearer realm="relay-server"`)
+            streams.WriteJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+            return
+        }
+        handler.ServeHTTP(w, r)
+    })
+}
+
+//backlog returns the cache statistics of a location, nil when it has no cache
+func (a *Admin) backlog(id string) *cache.Stats {
+    if a.Cache == nil {
+        return nil
+    }
+    for _, known := range a.Cache.Locations() {
+        if known == id {
+            wal, err := a.Cache.Location(id)
+            if err != nil {
+                return nil
+            }
+            stats := wal.Stats()
+            return &stats
+        }
+    }
+    return nil
+}
+
+//GET /api/streams lists the streams with their locations
+func (a *Admin) streams(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        streams.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+        return
+    }
+
+    views := []streamView{}
+    for _, stream := range activeConfig().Write.Streams {
+        view := streamView{Listen: stream.Listen, Validation: stream.Validation, Ack: stream.Ack, Locations: []locationView{}}
+        for _, locat := range stream.Locations {
+            view.Locations = append(view.Locations, locationView{
+                ID:      locat.ID(),
+                Name:    locat.Name,
+                Urls:    locat.Urls,
+                Cache:   locat.Cache,
+                Paused:  streams.Paused(locat.ID()),
+                Backlog: a.backlog(locat.ID()),
+            })
+        }
+        views = append(views, view)
+    }
+
+    streams.WriteJSON(w, http.StatusOK, views)
+}
+
+//GET /api/backends lists the backend urls with their breaker, health, requests in flight
+//and the cache backlog of the locations using them
+func (a *Admin) backends(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        streams.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+        return
+    }
+
+    locations := make(map[string][]string)
+    for _, stream := range activeConfig().Write.Streams {
+        for _, locat := range stream.Locations {
+            for _, url := range locat.Urls {
+                locations[url] = append(locations[url], locat.ID())
+            }
+        }
+    }
+
+    views := []backendView{}
+    for _, back := range backend.All() {
+        view := backendView{Status: back.Status(), Locations: locations[back.Url]}
+        if view.Locations == nil {
+            view.Locations = []string{}
+        }
+        for _, id := range view.Locations {
+            if stats := a.backlog(id); stats != nil {
+                view.Backlog.Entries += stats.Entries
+                view.Backlog.Bytes += stats.Bytes
+                if view.Backlog.Oldest.IsZero() || (!stats.Oldest.IsZero() && stats.Oldest.Before(view.Backlog.Oldest)) {
+                    view.Backlog.Oldest = stats.Oldest
+                }
+            }
+        }
+        views = append(views, view)
+    }
+
+    streams.WriteJSON(w, http.StatusOK, views)
+}
+
+//GET /api/config returns the running configuration without secrets
+func (a *Admin) config(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        streams.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+        return
+    }
+    content, err := activeConfig().Redacted().Marshal("json")
+    if err != nil {
+        streams.WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(content)
+}
+
+//POST /api/locations/<id>/pause and /api/locations/<id>/resume
+func (a *Admin) locations(w http.ResponseWriter, r *http.Request) {
+    parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/locations"), "/"), "/")
+    if len(parts) != 2 || r.Method != http.MethodPost {
+        streams.WriteJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+        return
+    }
+
+    id := parts[0]
+    if !a.known(id) {
+        streams.WriteJSON(w, http.StatusNotFound, map[string]string{"error": "unknown location"})
+        return
+    }
+
+    switch parts[1] {
+    case "pause":
+        streams.Pause(id)
+        streams.WriteJSON(w, http.StatusOK, map[string]string{"status": "paused"})
+    case "resume":
+        streams.Resume(id)
+        streams.WriteJSON(w, http.StatusOK, map[string]string{"status": "resumed"})
+    default:
+        streams.WriteJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+    }
+}
+
+//known reports whether a location id is configured or has a cache
+func (a *Admin) known(id string) bool {
+    for _, stream := range activeConfig().Write.Streams {
+        for _, locat := range stream.Locations {
+            if locat.ID() == id {
+                return true
+            }
+        }
+    }
+    return a.backlog(id) != nil
+}
+
+//POST /api/sync sends the open aggregate windows now and writes the cache logs of every location to disk
+func (a *Admin) sync(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        streams.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+        return
+    }
+
+    streams.FlushAggregates()
+    if a.Cache == nil {
+        streams.WriteJSON(w, http.StatusOK, map[string]interface{}{"status": "synced", "locations": []string{}})
+        return
+    }
+
+    ids := a.Cache.Locations()
+    for _, id := range ids {
+        wal, err := a.Cache.Location(id)
+        if err == nil {
+            err = wal.Sync()
+        }
+        if err != nil {
+            streams.WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+            return
+        }
+    }
+
+    streams.WriteJSON(w, http.StatusOK, map[string]interface{}{"status": "synced", "locations": ids})
+}
+
+//POST /api/replay and /api/replay/<id> start replaying the cache of every or one location now
+func (a *Admin) replay(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        streams.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+        return
+    }
+    if a.Cache == nil {
+        streams.WriteJSON(w, http.StatusConflict, map[string]string{"error": "cache is not enabled"})
+        return
+    }
+
+    ids := a.Cache.Locations()
+    if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/replay"), "/"); id != "" {
+        if a.backlog(id) == nil {
+            streams.WriteJSON(w, http.StatusNotFound, map[string]string{"error": "no cache for location"})
+            return
+        }
+        ids = []string{id}
+    }
+
+    replayer := newReplayer(activeConfig(), a.Cache)
+    for _, id := range ids {
+        wal, err := a.Cache.Location(id)
+        if err != nil {
+            streams.WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+            return
+        }
+        go replayer.Replay(wal)
+    }
+
+    streams.WriteJSON(w, http.StatusAccepted, map[string]interface{}{"status": "replaying", "locations": ids})
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "net/url"
+    "os"
+    "strings"
+    "text/tabwriter"
+    "time"
+    "github.com/ltkh/relay-server/internal/cache"
+    "github.com/ltkh/relay-server/internal/config"
+    "github.com/ltkh/relay-server/internal/streams"
+)
+
+const cacheUsage = `usage: relay-server cache <command> [flags]
+
+Inspects and manages the disk cache without a running server.
+Stop the server before replay or purge, they change the cache.
+
+commands:
+  stats     entries, size and age of every location
+  list      one line per cached batch
+  show      cached batches as line protocol
+  export    cached batches as an influx import file
+  replay    send cached batches of a location now
+  purge     drop cached batches older than a duration
+
+run "relay-server cache <command> -h" for the flags of a command
+`
+
+//cacheCommand runs a cache subcommand and returns the exit code
+func cacheCommand(args []string) int {
+    if len(args) == 0 {
+        fmt.Fprint(os.Stderr, cacheUsage)
+        return 2
+    }
+
+    fs := flag.NewFlagSet("cache "+args[0], flag.ContinueOnError)
+    cfFile    := fs.String("config", "", "config file, to find the cache directory and the locations")
+    dir       := fs.String("dir", "", "cache directory, overrides the one from the config file")
+    location  := fs.String("location", "", "location name or id, all locations when empty")
+    limit     := fs.Int("limit", 0, "maximum number of batches per location, 0 means all (list, show)")
+    output    := fs.String("output", "", "output file, stdout when empty (export)")
+    rate      := fs.Int64("rate", 0, "bytes per second, 0 means no limit (replay)")
+    olderThan := fs.Duration("older-than", -1, "age of the batches to drop, 0 drops everything (purge)")
+
+    if err := fs.Parse(args[1:]); err != nil {
+        return 2
+    }
+
+    cfg, err := cacheConfig(*cfFile, *dir)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[error] %v\n", err)
+        return 1
+    }
+
+    opts := cacheOptions(cfg)
+    switch args[0] {
+    case "stats", "list", "show", "export":
+        opts.ReadOnly = true
+    case "replay", "purge":
+    default:
+        fmt.Fprint(os.Stderr, cacheUsage)
+        return 2
+    }
+
+    store, err := cache.Open(cfg.Cache.Directory, opts)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[error] opening cache: %v\n", err)
+        return 1
+    }
+    defer store.Close()
+
+    ids := store.Locations()
+    if *location != "" {
+        ids = nil
+        for _, id := range store.Locations() {
+            if id == *location || locationName(cfg, id) == *location {
+                ids = append(ids, id)
+            }
+        }
+        if len(ids) == 0 {
+            fmt.Fprintf(os.Stderr, "[error] no cache for location %q\n", *location)
+            return 1
+        }
+    }
+
+    switch args[0] {
+    case "stats":
+        err = cacheStats(store, ids)
+    case "list":
+        err = cacheList(store, ids, *limit)
+    case "show":
+        err = cacheShow(store, ids, *limit)
+    case "export":
+        err = cacheExport(store, ids, *output)
+    case "replay":
+        err = cacheReplay(cfg, store, ids, *rate)
+    case "purge":
+        if *olderThan < 0 {
+            fmt.Fprintln(os.Stderr, "[error] purge needs -older-than")
+            return 2
+        }
+        err = cachePurge(store, ids, *olderThan)
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[error] %v\n", err)
+        return 1
+    }
+
+    return 0
+}
+
+//cacheConfig loads the config file when given, the cache directory alone is enough otherwise
+func cacheConfig(cfFile string, dir string) (*config.Config, error) {
+    cfg := &config.Config{}
+    if cfFile != "" {
+        var err error
+        if cfg, err = config.LoadConfigFile(cfFile); err != nil {
+            return nil, err
+        }
+    }
+    if dir != "" {
+        cfg.Cache.Directory = dir
+    }
+    if cfg.Cache.Directory == "" {
+        return nil, fmt.Errorf("cache directory is not set, use -config or -dir")
+    }
+    return cfg, nil
+}
+
+//locationName returns the name of the configured location with the given id
+func locationName(cfg *config.Config, id string) string {
+    for _, stream := range cfg.Write.Streams {
+        for _, locat := range stream.Locations {
+            if locat.ID() == id {
+                return locat.Name
+            }
+        }
+    }
+    return ""
+}
+
+//eachEntry calls fn for the unread batches of a log in order until it returns false
+func eachEntry(wal *cache.WAL, fn func(pos cache.Position, entry *cache.Entry, query *streams.Query) bool) error {
+    pos := wal.Position()
+    for {
+        data, next, err := wal.Read(pos)
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+
+        entry, err := cache.Decode(data)
+        if err != nil {
+            return fmt.Errorf("%s at %s: %v", wal.ID(), formatPosition(pos), err)
+        }
+        var query *streams.Query
+        if err := json.Unmarshal(entry.Data, &query); err != nil {
+            return fmt.Errorf("%s at %s: %v", wal.ID(), formatPosition(pos), err)
+        }
+
+        if !fn(pos, entry, query) {
+            return nil
+        }
+        pos = next
+    }
+}
+
+func formatPosition(pos cache.Position) string {
+    return fmt.Sprintf("%d:%d", pos.Segment, pos.Offset)
+}
+
+func formatAge(t time.Time) string {
+    if t.IsZero() {
+        return "-"
+    }
+    return time.Since(t).Round(time.Second).String()
+}
+
+func cacheStats(store *cache.Cache, ids []string) error {
+    tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(tw, "LOCATION\tENTRIES\tBYTES\tSEGMENTS\tOLDEST\tATTEMPTS\tLAST ERROR")
+
+    total := cache.Stats{}
+    for _, id := range ids {
+        wal, err := store.Location(id)
+        if err != nil {
+            return err
+        }
+        st := wal.Stats()
+        attempts, lastError := wal.Attempts()
+        fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%d\t%s\n", id, st.Entries, st.Bytes, st.Segments, formatAge(st.Oldest), attempts, lastError)
+        total.Entries += st.Entries
+        total.Bytes += st.Bytes
+        total.Segments += st.Segments
+    }
+    fmt.Fprintf(tw, "total\t%d\t%d\t%d\t\t\t\n", total.Entries, total.Bytes, total.Segments)
+
+    if letters, err := store.DeadLetter().List(); err == nil {
+        fmt.Fprintf(tw, "dead-letter\t%d\t\t\t\t\t\n", len(letters))
+    }
+
+    return tw.Flush()
+}
+
+func cacheList(store *cache.Cache, ids []string, limit int) error {
+    tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(tw, "LOCATION\tPOSITION\tSTREAM\tAGE\tSIZE\tPOINTS\tATTEMPTS\tQUERY")
+
+    for _, id := range ids {
+        wal, err := store.Location(id)
+        if err != nil {
+            return err
+        }
+        cnt := 0
+        err = eachEntry(wal, func(pos cache.Position, entry *cache.Entry, query *streams.Query) bool {
+            fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n", id, formatPosition(pos), entry.Stream, formatAge(entry.Failed),
+                len(query.Body), streams.CountPoints(strings.Split(string(query.Body), "\n")), entry.Attempts, query.Query)
+            cnt++
+            return limit <= 0 || cnt < limit
+        })
+        if err != nil {
+            return err
+        }
+    }
+
+    return tw.Flush()
+}
+
+func cacheShow(store *cache.Cache, ids []string, limit int) error {
+    out := bufio.NewWriter(os.Stdout)
+    defer out.Flush()
+
+    for _, id := range ids {
+        wal, err := store.Location(id)
+        if err != nil {
+            return err
+        }
+        cnt := 0
+        err = eachEntry(wal, func(pos cache.Position, entry *cache.Entry, query *streams.Query) bool {
+            fmt.Fprintf(out, "# location=%s position=%s stream=%s failed=%s attempts=%d query=%s\n", id, formatPosition(pos),
+                entry.Stream, entry.Failed.Format(time.RFC3339), entry.Attempts, query.Query)
+            if entry.Error != "" {
+                fmt.Fprintf(out, "# error=%s\n", entry.Error)
+            }
+            fmt.Fprintln(out, strings.TrimRight(string(query.Body), "\n"))
+            cnt++
+            return limit <= 0 || cnt < limit
+        })
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+//cacheExport writes the batches in the influx import format, switching the database context as needed
+func cacheExport(store *cache.Cache, ids []string, output string) error {
+    var file io.Writer = os.Stdout
+    if output != "" {
+        f, err := os.Create(output)
+        if err != nil {
+            return err
+        }
+        defer f.Close()
+        file = f
+    }
+
+    out := bufio.NewWriter(file)
+    fmt.Fprintln(out, "# DML")
+
+    db, rp := "", ""
+    for _, id := range ids {
+        wal, err := store.Location(id)
+        if err != nil {
+            return err
+        }
+        err = eachEntry(wal, func(pos cache.Position, entry *cache.Entry, query *streams.Query) bool {
+            params, _ := url.ParseQuery(query.Query)
+            if params.Get("db") != db {
+                db = params.Get("db")
+                fmt.Fprintf(out, "# CONTEXT-DATABASE: %s\n", db)
+            }
+            if params.Get("rp") != rp {
+                rp = params.Get("rp")
+                fmt.Fprintf(out, "# CONTEXT-RETENTION-POLICY: %s\n", rp)
+            }
+            for _, line := range strings.Split(string(query.Body), "\n") {
+                if strings.TrimSpace(line) != "" {
+                    fmt.Fprintln(out, line)
+                }
+            }
+            return true
+        })
+        if err != nil {
+            return err
+        }
+    }
+
+    return out.Flush()
+}
+
+//cacheReplay sends the batches of the locations until their cache is empty or a backend fails
+func cacheReplay(cfg *config.Config, store *cache.Cache, ids []string, rate int64) error {
+    configureBackends(cfg)
+    replayer := newReplayer(cfg, store)
+    replayer.Rate = rate
+    if replayer.Batch <= 0 {
+        replayer.Batch = 1000
+    }
+
+    for _, id := range ids {
+        wal, err := store.Location(id)
+        if err != nil {
+            return err
+        }
+        before := wal.Stats().Entries
+        for wal.Stats().Entries > 0 {
+            pos := wal.Position()
+            replayer.Replay(wal)
+            if wal.Position() == pos {
+                break
+            }
+        }
+        after := wal.Stats().Entries
+        fmt.Printf("%s: replayed %d, remaining %d\n", id, before-after, after)
+        if after > 0 {
+            attempts, lastError := wal.Attempts()
+            return fmt.Errorf("%s: replay stopped after %d attempts: %s", id, attempts, lastError)
+        }
+    }
+
+    return nil
+}
+
+//cachePurge drops the batches that failed longer ago than olderThan, oldest first
+func cachePurge(store *cache.Cache, ids []string, olderThan time.Duration) error {
+    for _, id := range ids {
+        wal, err := store.Location(id)
+        if err != nil {
+            return err
+        }
+        cnt := 0
+        for {
+            entry, next, err := wal.Head()
+            if err == io.EOF {
+                break
+            }
+            if err != nil {
+                return err
+            }
+            if olderThan > 0 && !entry.Failed.IsZero() && time.Since(entry.Failed) < olderThan {
+                break
+            }
+            if err := wal.Commit(next); err != nil {
+                return err
+            }
+            cnt++
+        }
+        fmt.Printf("%s: purged %d\n", id, cnt)
+    }
+
+    return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "net/url"
+    "os"
+    "strings"
+    "github.com/ltkh/relay-server/internal/config"
+    "github.com/ltkh/relay-server/internal/streams"
+)
+
+//checkCommand validates a config file and returns the exit code
+func checkCommand(args []string) int {
+    fs := flag.NewFlagSet("check", flag.ContinueOnError)
+    cfFile := fs.String("config", "", "config file")
+    fs.StringVar(&config.Format, "config.format", "", "config file format: yaml, toml or json, told by the extension when empty")
+    if err := fs.Parse(args); err != nil {
+        return 2
+    }
+    if *cfFile == "" && fs.NArg() > 0 {
+        *cfFile = fs.Arg(0)
+    }
+    if *cfFile == "" {
+        fmt.Fprintln(os.Stderr, "usage: relay-server check -config <file> [-config.format <format>]")
+        return 2
+    }
+
+    problems := config.Check(*cfFile)
+    for _, problem := range problems {
+        fmt.Fprintf(os.Stderr, "%s: %s\n", *cfFile, problem)
+    }
+    if len(problems) > 0 {
+        fmt.Fprintf(os.Stderr, "%s: %d problems found\n", *cfFile, len(problems))
+        return 1
+    }
+
+    fmt.Printf("%s: ok\n", *cfFile)
+    return 0
+}
+
+//testCommand shows what the streams of a config file do with the line protocol read from stdin,
+//without sending anything to the backends
+func testCommand(args []string) int {
+    fs := flag.NewFlagSet("test", flag.ContinueOnError)
+    cfFile := fs.String("config", "", "config file")
+    fs.StringVar(&config.Format, "config.format", "", "config file format: yaml, toml or json, told by the extension when empty")
+    listen := fs.String("stream", "", "listen address of the stream, all streams when empty")
+    query  := fs.String("query", "db=test", "query string of the write request")
+    client := fs.String("client", "127.0.0.1", "client address of the write request")
+    if err := fs.Parse(args); err != nil {
+        return 2
+    }
+    if *cfFile == "" {
+        fmt.Fprintln(os.Stderr, "usage: relay-server test -config <file> [-config.format <format>] [-stream <listen>] [-query <query>] < lines")
+        return 2
+    }
+
+    cfg, err := config.LoadConfigFile(*cfFile)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[error] loading configuration file: %v\n", err)
+        return 1
+    }
+    params, err := url.ParseQuery(*query)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[error] parsing query: %v\n", err)
+        return 2
+    }
+
+    body, err := ioutil.ReadAll(os.Stdin)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[error] reading stdin: %v\n", err)
+        return 1
+    }
+    lines := strings.Split(string(body), "\n")
+
+    found := false
+    for _, stream := range cfg.Write.Streams {
+        if *listen != "" && stream.Listen != *listen {
+            continue
+        }
+        found = true
+
+        ack := stream.Ack
+        if consistency := params.Get("consistency"); consistency != "" {
+            if ack, err = streams.ConsistencyAck(consistency); err != nil {
+                fmt.Fprintf(os.Stderr, "[error] %v\n", err)
+                return 2
+            }
+        }
+        if ack == "" {
+            ack = "async"
+        }
+        validation := stream.Validation
+        if validation == "" {
+            validation = "passthrough"
+        }
+        fmt.Printf("stream %s (validation %s, ack %s)\n", stream.Listen, validation, ack)
+
+        valid, errors := streams.ParseLines(lines)
+        fmt.Printf("  lines %d, valid %d, invalid %d\n", len(valid)+len(errors), len(valid), len(errors))
+        for _, lerr := range errors {
+            fmt.Printf("  line %d: %s\n", lerr.Line, lerr.Error)
+        }
+
+        send := lines
+        switch validation {
+        case "reject":
+            if len(errors) > 0 {
+                fmt.Printf("  request rejected with 400, nothing is forwarded\n\n")
+                continue
+            }
+        case "drop_invalid":
+            send = valid
+        }
+
+        rerouted, previews := streams.Preview(stream, send, params, *client)
+        printLines("  rerouted by the timestamp guard of the stream", rerouted)
+        for _, preview := range previews {
+            locat := preview.Location
+            name := locat.Name
+            if name == "" {
+                name = locat.ID()
+            }
+            route := "tried in order: " + strings.Join(locat.Urls, ", ")
+            if locat.Archive != nil {
+                route = "archived below " + locat.Archive.Directory
+            }
+            if locat.Cache && cfg.Cache.Enabled {
+                route += ", cached on failure"
+            }
+            fmt.Printf("  location %s, %s\n", name, route)
+            printLines("    rerouted by the timestamp guard", preview.Rerouted)
+            if len(preview.Sent) > 0 {
+                fmt.Printf("    POST ?%s\n", params.Encode())
+                for _, line := range preview.Sent {
+                    if line != "" {
+                        fmt.Printf("    %s\n", line)
+                    }
+                }
+            }
+            printLines("    aggregated, sent once the windows close", preview.Aggregated)
+        }
+        fmt.Println()
+    }
+
+    if !found {
+        fmt.Fprintf(os.Stderr, "[error] no stream listens on %q\n", *listen)
+        return 1
+    }
+
+    return 0
+}
+
+//printLines prints a titled list of lines, nothing when there are none
+func printLines(title string, lines []string) {
+    if len(lines) == 0 {
+        return
+    }
+    indent := title[:len(title)-len(strings.TrimLeft(title, " "))]
+    fmt.Printf("%s:\n", title)
+    for _, line := range lines {
+        fmt.Printf("%s  %s\n", indent, line)
+    }
+}
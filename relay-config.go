@@ -0,0 +1,77 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "github.com/ltkh/relay-server/internal/config"
+)
+
+const configUsage = `usage: relay-server config convert [flags] <file>
+
+Converts a config file between yaml, toml and json. Environment variables and
+includes are kept as they are, the result is checked against the known keys.
+`
+
+//configCommand runs a config subcommand and returns the exit code
+func configCommand(args []string) int {
+    if len(args) == 0 || args[0] != "convert" {
+        fmt.Fprint(os.Stderr, configUsage)
+        return 2
+    }
+
+    fs := flag.NewFlagSet("config convert", flag.ContinueOnError)
+    from   := fs.String("from", "", "format of the input file, told by the extension when empty")
+    to     := fs.String("to", "", "format of the output, told by the extension of -output when empty")
+    output := fs.String("output", "", "output file, stdout when empty")
+    if err := fs.Parse(args[1:]); err != nil {
+        return 2
+    }
+    if fs.NArg() != 1 {
+        fmt.Fprint(os.Stderr, configUsage)
+        return 2
+    }
+    input := fs.Arg(0)
+
+    if *from == "" {
+        *from = config.FormatOf(input)
+    }
+    if *to == "" {
+        if *output == "" {
+            fmt.Fprintln(os.Stderr, "[error] convert needs -to or -output")
+            return 2
+        }
+        *to = config.FormatOf(*output)
+    }
+
+    content, err := ioutil.ReadFile(input)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[error] %v\n", err)
+        return 1
+    }
+    tree, err := config.Decode(content, *from)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "[error] %s: %v\n", input, err)
+        return 1
+    }
+    if content, err = config.Encode(tree, *to); err != nil {
+        fmt.Fprintf(os.Stderr, "[error] %v\n", err)
+        return 1
+    }
+    if err := config.Validate(content, *to); err != nil {
+        fmt.Fprintf(os.Stderr, "[error] %s: %v\n", input, err)
+        return 1
+    }
+
+    if *output == "" {
+        os.Stdout.Write(content)
+        return 0
+    }
+    if err := ioutil.WriteFile(*output, content, 0644); err != nil {
+        fmt.Fprintf(os.Stderr, "[error] %v\n", err)
+        return 1
+    }
+
+    return 0
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "reflect"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/ltkh/relay-server/internal/cache"
+    "github.com/ltkh/relay-server/internal/config"
+    "github.com/ltkh/relay-server/internal/logger"
+    "github.com/ltkh/relay-server/internal/monitor"
+    "github.com/ltkh/relay-server/internal/streams"
+)
+
+var (
+    reloadMu sync.Mutex
+    active   atomic.Value
+)
+
+//activeConfig returns the config the server currently runs with
+func activeConfig() *config.Config {
+    return active.Load().(*config.Config)
+}
+
+//Reloader applies changes of the config file to the running server
+type Reloader struct {
+    File         string
+    Cache        *cache.Cache
+    DeadLetter   *cache.DeadLetter
+}
+
+//Reload loads the config file again and applies the difference: ports of removed streams are closed,
+//ports of new streams opened and the remaining streams switch to their new settings; when the new
+//config is invalid or a port can not be opened nothing changes
+func (r *Reloader) Reload() error {
+    reloadMu.Lock()
+    defer reloadMu.Unlock()
+
+    err := r.reload()
+    if err != nil {
+        monitor.ConfigReloads.WithLabelValues("failure").Inc()
+        monitor.ConfigReloadSuccess.Set(0)
+        log.Printf("[error] reloading configuration file: %v", err)
+        return err
+    }
+
+    monitor.ConfigReloads.WithLabelValues("success").Inc()
+    monitor.ConfigReloadSuccess.Set(1)
+    monitor.ConfigReloadTime.Set(float64(time.Now().Unix()))
+    log.Printf("[info] configuration file reloaded: %s", r.File)
+
+    return nil
+}
+
+func (r *Reloader) reload() error {
+    cfg, err := config.LoadConfigFile(r.File)
+    if err != nil {
+        return err
+    }
+
+    old := activeConfig()
+    //self_monitor is read by the emitter on every run and the client labels are set below,
+    //the rest of monit needs a restart
+    oldMonit, newMonit := old.Monit, cfg.Monit
+    oldMonit.Self_monitor, newMonit.Self_monitor = nil, nil
+    oldMonit.Client_label, oldMonit.Client_cidr_v4, oldMonit.Client_cidr_v6 = newMonit.Client_label, newMonit.Client_cidr_v4, newMonit.Client_cidr_v6
+    if !reflect.DeepEqual(old.Cache, cfg.Cache) || oldMonit != newMonit {
+        log.Printf("[info] reloading configuration file: cache and monit changes apply after a restart")
+        monit := cfg.Monit
+        cfg.Cache, cfg.Monit = old.Cache, old.Monit
+        cfg.Monit.Self_monitor = monit.Self_monitor
+        cfg.Monit.Client_label, cfg.Monit.Client_cidr_v4, cfg.Monit.Client_cidr_v6 = monit.Client_label, monit.Client_cidr_v4, monit.Client_cidr_v6
+    }
+
+    //opening the ports of new streams first, so a port in use leaves the old config running
+    listens := make(map[string]bool)
+    var opened []string
+    for i, stream := range cfg.Write.Streams {
+        if listens[stream.Listen] {
+            continue
+        }
+        listens[stream.Listen] = true
+        if _, ok := server[stream.Listen]; ok {
+            continue
+        }
+        if err := openPort(newWrite(cfg, i, r.Cache, r.DeadLetter)); err != nil {
+            for _, listen := range opened {
+                closePort(listen).Close()
+            }
+            return fmt.Errorf("opening write port: (%s) %v", stream.Listen, err)
+        }
+        opened = append(opened, stream.Listen)
+        logger.With(logger.Fields{"stream":stream.Listen}).Infof("opened write port")
+    }
+
+    for i, stream := range cfg.Write.Streams {
+        handler[stream.Listen].Store(newWrite(cfg, i, r.Cache, r.DeadLetter))
+    }
+
+    for listen := range server {
+        if listens[listen] {
+            continue
+        }
+        go func(srv *http.Server) {
+            if err := shutdown(srv, cfg.Write.Shutdown_timeout); err != nil {
+                logger.With(logger.Fields{"stream":srv.Addr}).Errorf("closing write port: %v", err)
+            }
+            logger.With(logger.Fields{"stream":srv.Addr}).Infof("closed write port")
+        }(closePort(listen))
+    }
+
+    configureBackends(cfg)
+    watchBackends(cfg)
+    monitor.SetClient(cfg.Monit.Client_label, cfg.Monit.Client_cidr_v4, cfg.Monit.Client_cidr_v6)
+
+    active.Store(cfg)
+    streams.PruneAggregates(cfg)
+
+    return nil
+}
+
+//ServeHTTP reloads the config file on POST /api/reload
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+    if req.Method != http.MethodPost {
+        streams.WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+        return
+    }
+    if err := r.Reload(); err != nil {
+        streams.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+        return
+    }
+    streams.WriteJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
@@ -1,101 +1,376 @@
 package main
 
 import (
+    "context"
     "flag"
+    "fmt"
     "log"
+    "net"
     "net/http"
     "os"
     "os/signal"
     "runtime"
     "syscall"
     "time"
-    "io/ioutil"
+    "strings"
     "encoding/json"
-    "gopkg.in/natefinch/lumberjack.v2"
+    "github.com/ltkh/relay-server/internal/backend"
+    "github.com/ltkh/relay-server/internal/cache"
     "github.com/ltkh/relay-server/internal/config"
+    "github.com/ltkh/relay-server/internal/logger"
     "github.com/ltkh/relay-server/internal/monitor"
     "github.com/ltkh/relay-server/internal/streams"
+    "github.com/prometheus/client_golang/prometheus"
 )
 
+//minCacheWait is the shortest pause between two cache replay passes, in seconds
+const minCacheWait = 1
+
 var (
-    server = make(map[string](*http.Server))
+    server  = make(map[string](*http.Server))
+    handler = make(map[string](*streams.Handler))
 )
 
-func openPorts(conf *config.Config) error {
+//newWrite returns the settings of the stream with index i
+func newWrite(conf *config.Config, i int, store *cache.Cache, dead *cache.DeadLetter) *streams.Write {
+    stream := conf.Write.Streams[i]
+    return &streams.Write{
+        Listen:        stream.Listen,
+        Validation:    stream.Validation,
+        Locations:     stream.Locations,
+        Timeout:       conf.Write.Timeout,
+        Repeat:        conf.Write.Repeat,
+        Retry:         conf.Write.Retry,
+        DelayTime:     conf.Write.Delay_time,
+        Cache:         store,
+        DeadLetter:    dead,
+        Ack:           stream.Ack,
+        AckTimeout:    stream.Ack_timeout,
+        Access:        accessLog(stream.Access_log),
+        Freshness:     stream.Freshness,
+        TimestampGuard: stream.Timestamp_guard,
+        Locate:        conf.Location,
+    }
+}
 
-    //opening write ports
-    for _, stream := range conf.Write.Streams {
-        server[stream.Listen] = &http.Server{ 
-            Addr: stream.Listen,
-            Handler: &streams.Write{
-                Listen:        stream.Listen,
-                Locations:     stream.Locations,
-                Timeout:       conf.Write.Timeout,
-                Repeat:        conf.Write.Repeat,
-                DelayTime:     conf.Write.Delay_time,
-                CacheDir:      conf.Cache.Directory,
-            },
-        }
-        go func(listen string) { 
-            if err := server[listen].ListenAndServe(); err != nil {
-                log.Printf("[info] opening write ports: (%s) %v", listen, err)
-            }
-        }(stream.Listen)
+//accessLog returns the access logger of a stream, nil when it has none
+func accessLog(conf *config.Access_log) *logger.Logger {
+    if conf == nil {
+        return nil
+    }
+    if conf.File == "" {
+        return logger.Default()
+    }
+    return logger.New(logger.File(conf.File))
+}
+
+//openPort starts serving a stream, the listener is opened before returning so errors are reported
+func openPort(write *streams.Write) error {
+    ln, err := net.Listen("tcp", write.Listen)
+    if err != nil {
+        return err
+    }
+
+    handler[write.Listen] = streams.NewHandler(write)
+    server[write.Listen] = &http.Server{
+        Addr:    write.Listen,
+        Handler: handler[write.Listen],
     }
+    go func(srv *http.Server) {
+        if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+            logger.With(logger.Fields{"stream":srv.Addr}).Errorf("serving write port: %v", err)
+        }
+    }(server[write.Listen])
 
     return nil
 }
 
-func closePorts(conf *config.Config) error {
+//closePort removes a stream from the open ports and returns its server
+func closePort(listen string) *http.Server {
+    srv := server[listen]
+    delete(server, listen)
+    delete(handler, listen)
+    return srv
+}
 
-    //closing write ports
-    for _, stream := range conf.Write.Streams {
-        if err := server[stream.Listen].Close(); err != nil {
+//shutdown stops accepting requests and waits up to timeout seconds for the running ones,
+//the connections still open after that are closed
+func shutdown(srv *http.Server, timeout time.Duration) error {
+    ctx, cancel := context.WithTimeout(context.Background(), timeout * time.Second)
+    defer cancel()
+
+    if err := srv.Shutdown(ctx); err != nil {
+        srv.Close()
+        return fmt.Errorf("(%s) %v", srv.Addr, err)
+    }
+
+    return nil
+}
+
+func openPorts(conf *config.Config, store *cache.Cache, dead *cache.DeadLetter) error {
+
+    //opening write ports
+    for i := range conf.Write.Streams {
+        if err := openPort(newWrite(conf, i, store, dead)); err != nil {
             return err
         }
-        time.Sleep(1000000)
     }
 
     return nil
 }
 
+func closePorts(timeout time.Duration) error {
+
+    //closing write ports at once, each one waits for its own requests
+    errs := make(chan error, len(server))
+    for listen := range server {
+        go func(srv *http.Server) {
+            errs <- shutdown(srv, timeout)
+        }(closePort(listen))
+    }
+
+    var err error
+    for i := cap(errs); i > 0; i-- {
+        if serr := <-errs; serr != nil && err == nil {
+            err = serr
+        }
+    }
+
+    return err
+}
+
+func cacheOptions(conf *config.Config) cache.Options {
+    return cache.Options{
+        SegmentSize:   conf.Cache.Segment_size,
+        Fsync:         conf.Cache.Fsync,
+        FsyncInterval: conf.Cache.Fsync_interval,
+        MaxBytes:      conf.Cache.Max_bytes,
+        MaxEntries:    conf.Cache.Max_entries,
+        MaxAge:        conf.Cache.Max_age,
+        MinFree:       conf.Cache.Min_free_bytes,
+        Eviction:      conf.Cache.Eviction,
+        MaxAttempts:   conf.Cache.Max_attempts,
+        DeadLetter:    conf.Cache.Dead_letter,
+    }
+}
+
+//configureBackends sets up the tls settings and the circuit breaker of every backend url, a location breaker
+//overriding the write one; the breakers of urls without one or no longer configured are disabled
+func configureBackends(conf *config.Config) {
+    configured := make(map[string]bool)
+    for _, stream := range conf.Write.Streams {
+        for _, locat := range stream.Locations {
+            tlsConf, err := locat.Tls.Config()
+            if err != nil {
+                logger.With(logger.Fields{"location":locat.ID()}).Errorf("loading tls config: %v", err)
+            }
+            for _, url := range locat.Urls {
+                backend.Get(url).SetTLS(tlsConf)
+            }
+
+            breaker := conf.Write.Breaker
+            if locat.Breaker != nil {
+                breaker = locat.Breaker
+            }
+            if breaker == nil {
+                continue
+            }
+            for _, url := range locat.Urls {
+                backend.Get(url).Configure(breaker.Failures, breaker.Cool_down)
+                configured[url] = true
+            }
+        }
+    }
+    for _, back := range backend.All() {
+        if !configured[back.Url] {
+            back.Configure(0, 0)
+        }
+    }
+}
+
+//watchBackends starts the health checks of the backend urls, a location check overriding the write one;
+//the checks of urls without one or no longer configured are stopped
+func watchBackends(conf *config.Config) {
+    watched := make(map[string]bool)
+    for _, stream := range conf.Write.Streams {
+        for _, locat := range stream.Locations {
+            hc := conf.Write.Health_check
+            if locat.Health_check != nil {
+                hc = locat.Health_check
+            }
+            if hc == nil {
+                continue
+            }
+            for _, url := range locat.Urls {
+                backend.Get(url).Watch(backend.HealthCheck{
+                    Path:      hc.Path,
+                    Interval:  hc.Interval,
+                    Timeout:   hc.Timeout,
+                    Healthy:   hc.Healthy,
+                    Unhealthy: hc.Unhealthy,
+                })
+                watched[url] = true
+            }
+        }
+    }
+    for _, back := range backend.All() {
+        if !watched[back.Url] {
+            back.Unwatch()
+        }
+    }
+}
+
+func newReplayer(conf *config.Config, store *cache.Cache) *streams.Replayer {
+    replayer := &streams.Replayer{
+        Cache:       store,
+        Locations:   make(map[string]config.Location),
+        Timeout:     conf.Write.Timeout,
+        DelayTime:   conf.Write.Delay_time,
+        Repeat:      conf.Write.Repeat,
+        Retry:       conf.Write.Retry,
+        Batch:       conf.Cache.Batch_cnt,
+        Concurrency: conf.Cache.Concurrency,
+        Rate:        conf.Cache.Rate,
+        Probe:       conf.Cache.Probe,
+        Pause:       conf.Cache.Wait,
+    }
+    for _, stream := range conf.Write.Streams {
+        for _, locat := range stream.Locations {
+            replayer.Locations[locat.ID()] = locat
+        }
+    }
+    return replayer
+}
+
 func main() {
 
+    //subcommands
+    if len(os.Args) > 1 {
+        switch os.Args[1] {
+        case "cache":
+            os.Exit(cacheCommand(os.Args[2:]))
+        case "check":
+            os.Exit(checkCommand(os.Args[2:]))
+        case "test":
+            os.Exit(testCommand(os.Args[2:]))
+        case "config":
+            os.Exit(configCommand(os.Args[2:]))
+        }
+    }
+
     //limits the number of operating system threads
     runtime.GOMAXPROCS(runtime.NumCPU())
 
     //command-line flag parsing
     cfFile          := flag.String("config", "", "config file")
+    cfFormat        := flag.String("config.format", "", "config file format: yaml, toml or json, told by the extension when empty")
     lgFile          := flag.String("logfile", "", "log file")
     logMaxSize      := flag.Int("log.max-size", 1, "log max size") 
     logMaxBackups   := flag.Int("log.max-backups", 3, "log max backups")
     logMaxAge       := flag.Int("log.max-age", 10, "log max age")
     logCompress     := flag.Bool("log.compress", true, "log compress")
+    logFormat       := flag.String("log.format", "text", "log format: text, logfmt or json")
+    logLevel        := flag.String("log.level", "info", "log level: debug, info, warn or error")
+    printConfig     := flag.Bool("print-config", false, "print the effective configuration, with includes, environment variables and defaults applied, and exit")
     flag.Parse()
 
+    //logging settings
+    if err := logger.Setup(*logFormat, *logLevel); err != nil {
+        log.Fatalf("[error] %v", err)
+    }
+    log.SetFlags(0)
+    log.SetOutput(logger.Writer())
+    logger.Rotation.MaxSize = *logMaxSize           // megabytes after which new file is created
+    logger.Rotation.MaxBackups = *logMaxBackups     // number of backups
+    logger.Rotation.MaxAge = *logMaxAge             // days
+    logger.Rotation.Compress = *logCompress         // using gzip
+
     //loading configuration file
+    config.Format = *cfFormat
     cfg, err := config.LoadConfigFile(*cfFile)
     if err != nil {
         log.Fatalf("[error] loading configuration file: %v", err)
     }
+    active.Store(cfg)
+
+    if *printConfig {
+        format := config.Format
+        if format == "" {
+            format = config.FormatOf(*cfFile)
+        }
+        content, err := cfg.Redacted().Marshal(format)
+        if err != nil {
+            log.Fatalf("[error] printing configuration: %v", err)
+        }
+        os.Stdout.Write(content)
+        return
+    }
+  
+    //setting up circuit breakers
+    configureBackends(cfg)
   
+    //opening cache
+    var store *cache.Cache
+    if cfg.Cache.Enabled {
+        store, err = cache.Open(cfg.Cache.Directory, cacheOptions(cfg))
+        if err != nil {
+            log.Fatalf("[error] opening cache: %v", err)
+        }
+        cnt, err := store.Migrate(func(data []byte) (string, error) { return locateQuery(cfg, data) })
+        if err != nil {
+            log.Fatalf("[error] migrating cache files: %v", err)
+        }
+        if cnt > 0 {
+            log.Printf("[info] migrated %d cache files", cnt)
+        }
+    }
+  
+    admin := &Admin{Token: cfg.Monit.Admin_token, Cache: store}
+
+    //opening dead-letter store
+    var dead *cache.DeadLetter
+    if store != nil {
+        dead = store.DeadLetter()
+    } else if cfg.Cache.Dead_letter != "" {
+        if dead, err = cache.OpenDeadLetter(cfg.Cache.Dead_letter); err != nil {
+            log.Fatalf("[error] opening dead-letter: %v", err)
+        }
+    }
+    if dead != nil {
+        handler := &streams.DeadLetters{Store: dead, Timeout: cfg.Write.Timeout, Config: activeConfig}
+        admin.Handle("/api/dead-letter", handler)
+        admin.Handle("/api/dead-letter/", handler)
+    }
+
+    //admin api and configuration reload
+    reloader := &Reloader{File: *cfFile, Cache: store, DeadLetter: dead}
+    admin.Register(reloader)
+    monitor.ConfigReloadSuccess.Set(1)
+    monitor.ConfigReloadTime.Set(float64(time.Now().Unix()))
+
     //opening monitoring port
+    monitor.SetClient(cfg.Monit.Client_label, cfg.Monit.Client_cidr_v4, cfg.Monit.Client_cidr_v6)
+    if store != nil {
+        prometheus.MustRegister(store)
+    }
     monitor.Start(cfg.Monit.Listen)
 
+    //checking backend health
+    watchBackends(cfg)
+
     //opening read/write ports
-    if err := openPorts(cfg); err != nil {
+    if err := openPorts(cfg, store, dead); err != nil {
         log.Fatalf("[error] opening read/write ports: %v", err)
     }
 
-    //logging settings
+    //emitting self-monitoring metrics, the self_monitor section may be added by a reload
+    hostname, _ := os.Hostname()
+    emitter := &streams.Emitter{Config: activeConfig, Hostname: hostname, Cache: store}
+    go emitter.Run()
+
+    //writing the log into a file
     if *lgFile != "" {
-        log.SetOutput(&lumberjack.Logger{
-            Filename:   *lgFile,
-            MaxSize:    *logMaxSize,    // megabytes after which new file is created
-            MaxBackups: *logMaxBackups, // number of backups
-            MaxAge:     *logMaxAge,     // days
-            Compress:   *logCompress,   // using gzip
-        })
+        logger.SetOutput(logger.File(*lgFile))
     }
 
     log.Print("[info] relay-server started o_O")
@@ -105,62 +380,80 @@ func main() {
     signal.Notify(c, os.Interrupt, syscall.SIGTERM)
     go func() {
         <-c
+        log.Print("[info] relay-server stopping")
+        reloadMu.Lock()
+        conf := activeConfig()
+
         //disabled streams
-        closePorts(cfg)
+        if err := closePorts(conf.Write.Shutdown_timeout); err != nil {
+            log.Printf("[error] closing write ports: %v", err)
+        }
+
+        //waiting for in-flight sends and then the open aggregate windows, the ones still retrying are cached
+        if !streams.Drain(conf.Write.Drain_timeout) {
+            log.Printf("[info] drain timeout exceeded, undelivered batches of cached locations were written to the cache")
+        }
+        streams.CloseArchives()
+
+        if store != nil {
+            if err := store.Close(); err != nil {
+                log.Printf("[error] closing cache: %v", err)
+            }
+        }
 
         log.Print("[info] relay-server stopped")
         os.Exit(0)
     }()
 
+    //configuration reload signal processing
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    go func() {
+        for range hup {
+            reloader.Reload()
+        }
+    }()
+
     //daemon mode
     for {
 
-          if cfg.Cache.Enabled {
-
-            files, err := ioutil.ReadDir(cfg.Cache.Directory)
-            if err != nil {
-                log.Printf("[error] reading cache directory: %v", err)
-            }
-
-            cnt := 0
-
-            for _, file := range files { 
-                
-                cnt++
-
-                if cnt > cfg.Cache.Batch_cnt {
-                    break
-                }
-
-                path := cfg.Cache.Directory+"/"+file.Name()
-
-                data, err := ioutil.ReadFile(path)
+        if store != nil {
+            replayer := newReplayer(activeConfig(), store)
+            store.Enforce()
+            for _, id := range store.Locations() {
+                wal, err := store.Location(id)
                 if err != nil {
-                    log.Printf("[error] reading cache file: %s", file.Name())
-                    if err := os.Remove(path); err != nil {
-                        log.Printf("[error] deleting cache file: %v", err)
-                    }
+                    logger.With(logger.Fields{"location":id}).Errorf("opening cache: %v", err)
                     continue
                 }
+                go replayer.Replay(wal)
+            }
+        }
 
-                var query *streams.Query
-                if err := json.Unmarshal(data, &query); err != nil {
-                    log.Printf("[error] reading cache file: %v", err)
-                    if err := os.Remove(path); err != nil {
-                        log.Printf("[error] deleting cache file: %v", err)
-                    }
-                    continue
-                }
+        //a reload may change the interval, it is read again on every pass
+        wait := activeConfig().Cache.Wait
+        if wait < minCacheWait {
+            wait = minCacheWait
+        }
+        time.Sleep(wait * time.Second)
+    }
 
-                go streams.Sender(query, 0, 0, 0, true, cfg.Cache.Directory)
+}
 
-                if err := os.Remove(path); err != nil {
-                    log.Printf("[error] deleting cache file: %v", err)
-                }
+//locateQuery finds the location a cache file of an older version belongs to by its urls
+func locateQuery(conf *config.Config, data []byte) (string, error) {
+    var query *streams.Query
+    if err := json.Unmarshal(data, &query); err != nil {
+        return "", err
+    }
+
+    for _, stream := range conf.Write.Streams {
+        for _, locat := range stream.Locations {
+            if strings.Join(locat.Urls, ",") == strings.Join(query.Urls, ",") {
+                return locat.ID(), nil
             }
         }
-
-        time.Sleep(cfg.Cache.Wait * time.Second)
     }
 
-}
\ No newline at end of file
+    return config.Location{Urls: query.Urls}.ID(), nil
+}